@@ -120,6 +120,235 @@ func createTables() {
 			CONSTRAINT fk_chat FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE,
 			CONSTRAINT fk_sender FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS user_blocks (
+			blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			PRIMARY KEY (blocker_id, blocked_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks (blocked_id)`,
+		`ALTER TABLE chat_members ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE chat_members ADD COLUMN IF NOT EXISTS cleared_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS description TEXT`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS topic VARCHAR(255)`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS avatar TEXT`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_system BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS chat_type VARCHAR(20) NOT NULL DEFAULT 'group'`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS slow_mode_seconds INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS default_disappear_after INTEGER`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS retention_days INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS chat_edits (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+			field VARCHAR(50) NOT NULL,
+			old_value TEXT,
+			new_value TEXT,
+			edited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			edited_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_edits_chat ON chat_edits (chat_id, edited_at DESC)`,
+		`CREATE TABLE IF NOT EXISTS chat_invites (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+			token VARCHAR(64) UNIQUE NOT NULL,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			expires_at TIMESTAMP WITH TIME ZONE,
+			max_uses INTEGER,
+			use_count INTEGER NOT NULL DEFAULT 0,
+			requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+			revoked_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_invites_chat ON chat_invites (chat_id)`,
+		`CREATE TABLE IF NOT EXISTS chat_join_requests (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			invite_id UUID REFERENCES chat_invites(id) ON DELETE SET NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			decided_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			decided_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_join_requests_pending
+			ON chat_join_requests (chat_id, user_id) WHERE status = 'pending'`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS disappear_mode VARCHAR(10)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE`,
+		`CREATE TABLE IF NOT EXISTS message_expiries (
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			notified BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY (message_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_message_expiries_pending ON message_expiries (expires_at) WHERE NOT notified`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS read_receipts BOOLEAN NOT NULL DEFAULT TRUE`,
+		`CREATE TABLE IF NOT EXISTS message_receipts (
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			delivered_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			read_at TIMESTAMP WITH TIME ZONE,
+			PRIMARY KEY (message_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_receipts_user ON message_receipts (user_id, message_id)`,
+		// Carry the old chat-wide is_read flag over once, when the receipts
+		// table is first created.
+		`INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+			SELECT m.id, cm.user_id, m.sent_at, m.sent_at
+			FROM messages m
+			JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id != m.sender_id
+			WHERE m.is_read = TRUE
+			  AND NOT EXISTS (SELECT 1 FROM message_receipts)
+			ON CONFLICT DO NOTHING`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE`,
+		`CREATE TABLE IF NOT EXISTS message_edits (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			content TEXT NOT NULL,
+			edited_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits (message_id, edited_at)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE TABLE IF NOT EXISTS message_hidden (
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			hidden_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (message_id, user_id)
+		)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_root_id UUID REFERENCES messages(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages (thread_root_id, sent_at, id) WHERE thread_root_id IS NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS thread_reads (
+			root_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			last_read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			PRIMARY KEY (root_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_reactions (
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			emoji VARCHAR(32) NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			PRIMARY KEY (message_id, user_id, emoji)
+		)`,
+		// Attachments outlive their message or chat only until the janitor
+		// has deleted the blob, hence SET NULL rather than CASCADE.
+		`CREATE TABLE IF NOT EXISTS attachments (
+			id UUID PRIMARY KEY,
+			chat_id UUID REFERENCES chats(id) ON DELETE SET NULL,
+			message_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+			uploader_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			storage_key TEXT NOT NULL,
+			file_name VARCHAR(255) NOT NULL,
+			content_type VARCHAR(255) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			linked_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachments_orphaned ON attachments (created_at) WHERE message_id IS NULL`,
+		// Only plain, permanent messages in non-secure chats are searchable;
+		// everything else keeps a NULL search_vector. secure_until is when a
+		// secure chat was last made plain: what was sent before it is
+		// ciphertext and stays out of the index.
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector TSVECTOR`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS secure_until TIMESTAMP WITH TIME ZONE`,
+		`CREATE OR REPLACE FUNCTION messages_search_vector() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.is_system OR NEW.is_disappearing OR NEW.deleted_at IS NOT NULL
+				OR (SELECT is_secure OR NEW.sent_at <= COALESCE(secure_until, '-infinity')
+					FROM chats WHERE id = NEW.chat_id) THEN
+				NEW.search_vector := NULL;
+			ELSE
+				NEW.search_vector := to_tsvector('simple', NEW.content);
+			END IF;
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS messages_search_vector ON messages`,
+		`CREATE TRIGGER messages_search_vector
+			BEFORE INSERT OR UPDATE OF content, is_disappearing, deleted_at ON messages
+			FOR EACH ROW EXECUTE FUNCTION messages_search_vector()`,
+		// Messages from before search existed are indexed once; from then on
+		// the trigger keeps the index current.
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			name VARCHAR(100) PRIMARY KEY,
+			applied_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM schema_migrations WHERE name = 'messages_search_backfill') THEN
+				UPDATE messages m SET search_vector = to_tsvector('simple', m.content)
+				FROM chats c
+				WHERE c.id = m.chat_id AND m.search_vector IS NULL AND NOT c.is_secure
+				  AND m.sent_at > COALESCE(c.secure_until, '-infinity')
+				  AND NOT COALESCE(m.is_system, FALSE) AND NOT COALESCE(m.is_disappearing, FALSE)
+				  AND m.deleted_at IS NULL;
+				INSERT INTO schema_migrations (name) VALUES ('messages_search_backfill');
+			END IF;
+		END
+		$$`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_vector)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS entities JSONB`,
+		`CREATE TABLE IF NOT EXISTS message_mentions (
+			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			read_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			PRIMARY KEY (message_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_mentions_user ON message_mentions (user_id, created_at DESC)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_forwarded BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from_id UUID REFERENCES messages(id) ON DELETE SET NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned_by UUID REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_pinned ON messages (chat_id, pinned_at) WHERE pinned_at IS NOT NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_message_id VARCHAR(64)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_id ON messages (chat_id, sender_id, client_message_id)
+			WHERE client_message_id IS NOT NULL`,
+		// Scheduled messages wait here rather than in messages so that no
+		// message query has to filter them out.
+		`CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id UUID PRIMARY KEY,
+			chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+			sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			client_message_id VARCHAR(64),
+			content TEXT NOT NULL DEFAULT '',
+			is_disappearing BOOLEAN NOT NULL DEFAULT FALSE,
+			disappear_after INTEGER,
+			disappear_mode VARCHAR(10),
+			reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+			mentions TEXT[],
+			send_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages (send_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_sender ON scheduled_messages (chat_id, sender_id, send_at)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_scheduled_messages_client_id
+			ON scheduled_messages (chat_id, sender_id, client_message_id) WHERE client_message_id IS NOT NULL`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scheduled_message_id UUID
+			REFERENCES scheduled_messages(id) ON DELETE SET NULL`,
+		// Messages from before kinds existed are classified once, then the
+		// column gets its default.
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind VARCHAR(20)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS payload JSONB`,
+		`UPDATE messages m SET kind = CASE
+				WHEN m.is_system THEN 'system'
+				WHEN m.content = '' AND EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id) THEN 'attachment'
+				ELSE 'text'
+			END
+			WHERE m.kind IS NULL`,
+		`ALTER TABLE messages ALTER COLUMN kind SET DEFAULT 'text'`,
+		`ALTER TABLE messages ALTER COLUMN kind SET NOT NULL`,
+		`ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'text'`,
+		`ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS payload JSONB`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_members_user ON chat_members (user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_chat_sent ON messages (chat_id, sent_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_chats_last_activity ON chats ((COALESCE(last_message_at, created_at)) DESC, id DESC)`,
 	}
 
 	for _, query := range queries {
@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+	"qrconnect-backend/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	maxAttachmentNameLength  = 255
+
+	// attachmentPreview stands in for the chat's last message when a
+	// message has attachments but no text.
+	attachmentPreview = "Attachment"
+)
+
+var (
+	blobStore     storage.BlobStore
+	blobStoreOnce sync.Once
+
+	errInvalidAttachments = errors.New("attachmentIds must be your own unused uploads to this chat")
+
+	// attachmentMetrics is published at /debug/vars under "attachments".
+	attachmentMetrics = expvar.NewMap("attachments")
+)
+
+// blobs returns the configured BlobStore, built on first use so settings
+// loaded from .env are picked up.
+func blobs() storage.BlobStore {
+	blobStoreOnce.Do(func() {
+		blobStore = storage.FromEnv()
+	})
+	return blobStore
+}
+
+func attachmentURL(chatID, attachmentID uuid.UUID) string {
+	return "/api/chats/" + chatID.String() + "/attachments/" + attachmentID.String()
+}
+
+// cleanAttachmentName keeps only the base name of an uploaded file, so a
+// client cannot smuggle a path into the download headers.
+func cleanAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	if runes := []rune(name); len(runes) > maxAttachmentNameLength {
+		name = string(runes[:maxAttachmentNameLength])
+	}
+	return name
+}
+
+// uploadedFile is the "file" part of an upload request. Reading it returns
+// the whole file, including the bytes already read to sniff its type.
+type uploadedFile struct {
+	io.Reader
+	file        multipart.File
+	name        string
+	size        int64
+	contentType string
+}
+
+func (u *uploadedFile) Close() error {
+	return u.file.Close()
+}
+
+// readUpload opens the "file" part of a multipart request of at most maxBytes
+// and sniffs its content type from the data, ignoring what the client
+// claimed. On failure it returns the status to respond with.
+func readUpload(c *gin.Context, maxBytes int64) (*uploadedFile, int, error) {
+	tooLarge := fmt.Errorf("Attachments cannot exceed %d bytes", maxBytes)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64<<10)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, http.StatusRequestEntityTooLarge, tooLarge
+		}
+		return nil, http.StatusBadRequest, errors.New("A file is required")
+	}
+
+	if header.Size > maxBytes {
+		file.Close()
+		return nil, http.StatusRequestEntityTooLarge, tooLarge
+	}
+
+	if header.Size == 0 {
+		file.Close()
+		return nil, http.StatusBadRequest, errors.New("File is empty")
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, http.StatusBadRequest, errors.New("Failed to read file")
+	}
+	sniff = sniff[:n]
+
+	return &uploadedFile{
+		Reader:      io.MultiReader(bytes.NewReader(sniff), file),
+		file:        file,
+		name:        header.Filename,
+		size:        header.Size,
+		contentType: http.DetectContentType(sniff),
+	}, 0, nil
+}
+
+// UploadAttachmentHandler stores a file for later use in a message in this
+// chat. The content type is sniffed from the data rather than trusted from
+// the client. Uploads that are never sent are removed by the attachment
+// janitor.
+func UploadAttachmentHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	if _, err := getMemberRole(db.DB(), chatUUID, userUUID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	upload, status, err := readUpload(c, int64(envInt("ATTACHMENT_MAX_BYTES", 25<<20)))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	defer upload.Close()
+
+	attachment := models.Attachment{
+		ID:          uuid.New(),
+		ChatID:      chatUUID,
+		UploaderID:  userUUID,
+		FileName:    cleanAttachmentName(upload.name),
+		ContentType: upload.contentType,
+		Size:        upload.size,
+		CreatedAt:   time.Now(),
+	}
+	attachment.URL = attachmentURL(chatUUID, attachment.ID)
+	key := "attachments/" + chatUUID.String() + "/" + attachment.ID.String()
+
+	err = blobs().Put(c.Request.Context(), key, upload, upload.size, attachment.ContentType)
+	if err != nil {
+		log.Printf("Error storing attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+
+	_, err = db.DB().Exec(`
+		INSERT INTO attachments (id, chat_id, uploader_id, storage_key, file_name, content_type, size_bytes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, attachment.ID, chatUUID, userUUID, key, attachment.FileName, attachment.ContentType,
+		attachment.Size, attachment.CreatedAt)
+
+	if err != nil {
+		blobs().Delete(c.Request.Context(), key)
+		log.Printf("Error saving attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+
+	attachmentMetrics.Add("uploaded", 1)
+	attachmentMetrics.Add("uploadedBytes", attachment.Size)
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// GetAttachmentHandler streams an attachment to a member of its chat who can
+// see the message it belongs to. An upload not yet sent is only visible to
+// its uploader.
+func GetAttachmentHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	attachmentUUID, err := uuid.Parse(c.Param("attachmentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	var key, fileName, contentType string
+	var size int64
+	err = db.DB().QueryRow(`
+		SELECT a.storage_key, a.file_name, a.content_type, a.size_bytes
+		FROM attachments a
+		WHERE a.id = $4 AND a.chat_id = $1
+		  AND (
+			(a.message_id IS NULL AND a.linked_at IS NULL AND a.uploader_id = $3)
+			OR EXISTS (
+				SELECT 1 FROM messages m
+				WHERE `+messageVisibility+` AND m.id = a.message_id AND m.deleted_at IS NULL
+			)
+		  )
+	`, chatUUID, clearedAt, userUUID, attachmentUUID).Scan(&key, &fileName, &contentType, &size)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	body, err := blobs().Get(c.Request.Context(), key)
+	if err == storage.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error reading attachment %s: %v", attachmentUUID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer body.Close()
+
+	// Only images are shown inline; anything else is a download, so an
+	// uploaded HTML file can never run in the app's origin.
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.DataFromReader(http.StatusOK, size, contentType, body, nil)
+}
+
+// linkAttachments attaches the sender's uploads to a new message. It must run
+// in the message's transaction.
+func linkAttachments(tx *sql.Tx, chatID, senderID, messageID uuid.UUID, attachmentIDs []uuid.UUID) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		UPDATE attachments
+		SET message_id = $1, linked_at = NOW()
+		WHERE id = ANY($2::uuid[]) AND chat_id = $3 AND uploader_id = $4
+		  AND message_id IS NULL AND linked_at IS NULL
+		  AND (scheduled_message_id IS NULL OR scheduled_message_id = $1)
+	`, messageID, pq.Array(uuidStrings(attachmentIDs)), chatID, senderID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); int(n) != len(attachmentIDs) {
+		return errInvalidAttachments
+	}
+	return nil
+}
+
+// parseAttachmentIDs validates the attachmentIds of a send request.
+func parseAttachmentIDs(raw []string) ([]uuid.UUID, error) {
+	if len(raw) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("a message can have at most %d attachments", maxAttachmentsPerMessage)
+	}
+
+	seen := map[uuid.UUID]bool{}
+	ids := make([]uuid.UUID, 0, len(raw))
+	for _, s := range raw {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, errors.New("Invalid attachment ID")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// fillAttachments sets the attachments on a page of messages.
+func fillAttachments(q queryer, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(messages))
+	index := map[uuid.UUID]int{}
+	for i, message := range messages {
+		ids[i] = message.ID
+		index[message.ID] = i
+	}
+
+	rows, err := q.Query(`
+		SELECT id, chat_id, message_id, uploader_id, file_name, content_type, size_bytes, created_at
+		FROM attachments
+		WHERE message_id = ANY($1::uuid[])
+		ORDER BY created_at, id
+	`, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment models.Attachment
+		var messageID uuid.UUID
+		err := rows.Scan(&attachment.ID, &attachment.ChatID, &messageID, &attachment.UploaderID,
+			&attachment.FileName, &attachment.ContentType, &attachment.Size, &attachment.CreatedAt)
+		if err != nil {
+			return err
+		}
+		attachment.MessageID = &messageID
+		attachment.URL = attachmentURL(attachment.ChatID, attachment.ID)
+
+		message := &messages[index[messageID]]
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	return rows.Err()
+}
+
+// StartAttachmentJanitor periodically removes attachments that no longer
+// belong to anything: uploads never sent within ATTACHMENT_ORPHAN_TTL, and
+// uploads whose message or chat has been deleted. ATTACHMENT_GC_INTERVAL
+// sets how often it runs.
+func StartAttachmentJanitor() {
+	interval := envDuration("ATTACHMENT_GC_INTERVAL", time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		collectOrphanedAttachments(envDuration("ATTACHMENT_ORPHAN_TTL", 24*time.Hour), 100)
+		<-ticker.C
+	}
+}
+
+func collectOrphanedAttachments(ttl time.Duration, batchSize int) {
+	started := time.Now()
+	attachmentMetrics.Add("gcRuns", 1)
+
+	for {
+		n, err := collectAttachmentBatch(started.Add(-ttl), batchSize)
+		if err != nil {
+			log.Printf("Error collecting orphaned attachments: %v", err)
+			attachmentMetrics.Add("gcErrors", 1)
+			break
+		}
+		if n < batchSize {
+			break
+		}
+	}
+
+	attachmentMetrics.Set("lastGcUnix", expvarInt(started.Unix()))
+}
+
+// collectAttachmentBatch deletes up to batchSize orphaned blobs and their
+// rows. A row is only removed once its blob is gone, so a failed delete is
+// retried on the next run.
+func collectAttachmentBatch(cutoff time.Time, batchSize int) (int, error) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, storage_key FROM attachments
+		WHERE message_id IS NULL AND scheduled_message_id IS NULL
+		  AND (linked_at IS NOT NULL OR chat_id IS NULL OR created_at < $1)
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, cutoff, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	orphans := []orphanedAttachment{}
+	for rows.Next() {
+		var o orphanedAttachment
+		if err := rows.Scan(&o.id, &o.key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed, err := removeOrphans(txBlobUsage{tx}, blobs(), orphans)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(removed) > 0 {
+		_, err = tx.Exec(`DELETE FROM attachments WHERE id = ANY($1::uuid[])`, pq.Array(uuidStrings(removed)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	attachmentMetrics.Add("collected", int64(len(removed)))
+	return len(removed), nil
+}
+
+// orphanedAttachment is an attachment row the janitor is collecting.
+type orphanedAttachment struct {
+	id  uuid.UUID
+	key string
+}
+
+// blobUsage tells the janitor whether a blob is still in use.
+type blobUsage interface {
+	// keyInUse reports whether an attachment row other than those in except
+	// refers to key.
+	keyInUse(key string, except []uuid.UUID) (bool, error)
+}
+
+// txBlobUsage answers from the janitor's transaction.
+type txBlobUsage struct {
+	tx *sql.Tx
+}
+
+func (u txBlobUsage) keyInUse(key string, except []uuid.UUID) (bool, error) {
+	// The lock makes instances collecting two rows with the same key at once
+	// see each other's deletes.
+	if _, err := u.tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+		return false, err
+	}
+
+	var inUse bool
+	err := u.tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM attachments
+			WHERE storage_key = $1 AND NOT (id = ANY($2::uuid[]))
+		)
+	`, key, pq.Array(uuidStrings(except))).Scan(&inUse)
+	return inUse, err
+}
+
+// removeOrphans deletes the blobs of orphaned rows and returns the rows that
+// can go. Forwarded attachments share a blob, which goes with the last row
+// that uses it. A row whose blob could not be deleted is kept for the next
+// run.
+func removeOrphans(usage blobUsage, store storage.BlobStore, orphans []orphanedAttachment) ([]uuid.UUID, error) {
+	removed := []uuid.UUID{}
+	for _, o := range orphans {
+		inUse, err := usage.keyInUse(o.key, append(removed, o.id))
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			removed = append(removed, o.id)
+			continue
+		}
+
+		if err := store.Delete(context.Background(), o.key); err != nil {
+			log.Printf("Error deleting attachment blob %s: %v", o.key, err)
+			continue
+		}
+		removed = append(removed, o.id)
+	}
+	return removed, nil
+}
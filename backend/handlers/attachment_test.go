@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// uploadContext builds a request context carrying a multipart upload of data
+// under the "file" field, declared with the given content type.
+func uploadContext(t *testing.T, fileName, declaredType string, data []byte) *gin.Context {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+fileName+`"`)
+	header.Set("Content-Type", declaredType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/chats/x/attachments", &body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+	return c
+}
+
+func TestReadUploadSizeLimits(t *testing.T) {
+	const maxBytes = 1024
+
+	tests := []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{"within the limit", maxBytes, 0},
+		{"just over the limit", maxBytes + 1, http.StatusRequestEntityTooLarge},
+		{"far over the limit", maxBytes + 128<<10, http.StatusRequestEntityTooLarge},
+		{"empty", 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := uploadContext(t, "data.bin", "application/octet-stream", bytes.Repeat([]byte{'a'}, tt.size))
+
+			upload, status, err := readUpload(c, maxBytes)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("readUpload: %v", err)
+				}
+				defer upload.Close()
+				if upload.size != int64(tt.size) {
+					t.Errorf("size = %d, want %d", upload.size, tt.size)
+				}
+				return
+			}
+
+			if err == nil {
+				upload.Close()
+				t.Fatal("readUpload succeeded, want an error")
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
+
+func TestReadUploadMissingFile(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/chats/x/attachments", nil)
+
+	if _, status, err := readUpload(c, 1024); err == nil || status != http.StatusBadRequest {
+		t.Fatalf("readUpload without a file: status %d, err %v; want 400", status, err)
+	}
+}
+
+func TestReadUploadSniffsContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+
+	tests := []struct {
+		name         string
+		declaredType string
+		data         []byte
+		want         string
+	}{
+		{"image as declared", "image/png", png, "image/png"},
+		{"image declared as text", "text/plain", png, "image/png"},
+		{"html posing as an image", "image/png", html, "text/html; charset=utf-8"},
+		{"unknown binary", "image/png", []byte{0x00, 0x01, 0x02, 0x03}, "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := uploadContext(t, "file.png", tt.declaredType, tt.data)
+
+			upload, _, err := readUpload(c, 1<<20)
+			if err != nil {
+				t.Fatalf("readUpload: %v", err)
+			}
+			defer upload.Close()
+
+			if upload.contentType != tt.want {
+				t.Errorf("content type = %q, want %q", upload.contentType, tt.want)
+			}
+
+			// The sniffed bytes must still be part of what gets stored.
+			got, err := io.ReadAll(upload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestCleanAttachmentName(t *testing.T) {
+	tests := map[string]string{
+		"photo.jpg":            "photo.jpg",
+		"../../etc/passwd":     "passwd",
+		`C:\Users\me\doc.pdf`:  "doc.pdf",
+		"evil\".html":          "evil.html",
+		"line\r\nbreak.txt":    "linebreak.txt",
+		"":                     "file",
+		"/":                    "file",
+		"dir/":                 "dir",
+		"tab\there\x7fend.txt": "tabhereend.txt",
+	}
+
+	for in, want := range tests {
+		if got := cleanAttachmentName(in); got != want {
+			t.Errorf("cleanAttachmentName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// fakeAttachmentRows stands in for the attachments table, mapping row IDs to
+// storage keys.
+type fakeAttachmentRows map[uuid.UUID]string
+
+func (rows fakeAttachmentRows) keyInUse(key string, except []uuid.UUID) (bool, error) {
+	skip := map[uuid.UUID]bool{}
+	for _, id := range except {
+		skip[id] = true
+	}
+	for id, k := range rows {
+		if k == key && !skip[id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fakeBlobStore records deletes and fails them for the keys in failing.
+type fakeBlobStore struct {
+	deleted []string
+	failing map[string]bool
+}
+
+func (s *fakeBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return nil
+}
+
+func (s *fakeBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeBlobStore) Delete(ctx context.Context, key string) error {
+	if s.failing[key] {
+		return errors.New("unavailable")
+	}
+	s.deleted = append(s.deleted, key)
+	return nil
+}
+
+func TestRemoveOrphansSharedKeys(t *testing.T) {
+	live := uuid.New()
+	orphanA, orphanB := uuid.New(), uuid.New()
+	sharedWithLive := uuid.New()
+	unshared := uuid.New()
+
+	rows := fakeAttachmentRows{
+		// A forwarded copy still in use shares its blob with an orphan.
+		live:           "attachments/shared-live",
+		sharedWithLive: "attachments/shared-live",
+		// Two orphans share a blob nothing else uses.
+		orphanA:  "attachments/shared-orphans",
+		orphanB:  "attachments/shared-orphans",
+		unshared: "attachments/unshared",
+	}
+	orphans := []orphanedAttachment{
+		{orphanA, rows[orphanA]},
+		{sharedWithLive, rows[sharedWithLive]},
+		{orphanB, rows[orphanB]},
+		{unshared, rows[unshared]},
+	}
+	store := &fakeBlobStore{}
+
+	removed, err := removeOrphans(rows, store, orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != len(orphans) {
+		t.Errorf("removed %d rows, want all %d orphans", len(removed), len(orphans))
+	}
+	for _, id := range removed {
+		if id == live {
+			t.Error("removed the row still in use")
+		}
+	}
+
+	wantDeleted := map[string]bool{"attachments/shared-orphans": true, "attachments/unshared": true}
+	if len(store.deleted) != len(wantDeleted) {
+		t.Errorf("deleted blobs %v, want each of %v once", store.deleted, wantDeleted)
+	}
+	for _, key := range store.deleted {
+		if !wantDeleted[key] {
+			t.Errorf("deleted blob %s, which is still in use", key)
+		}
+	}
+}
+
+func TestRemoveOrphansKeepsRowWhenDeleteFails(t *testing.T) {
+	failed, ok := uuid.New(), uuid.New()
+	rows := fakeAttachmentRows{failed: "attachments/failing", ok: "attachments/ok"}
+	store := &fakeBlobStore{failing: map[string]bool{"attachments/failing": true}}
+
+	removed, err := removeOrphans(rows, store, []orphanedAttachment{
+		{failed, rows[failed]},
+		{ok, rows[ok]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != ok {
+		t.Errorf("removed %v, want only %v", removed, ok)
+	}
+}
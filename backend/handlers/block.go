@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// blockTarget parses the caller and the user in the path of a block request.
+// It writes the error response itself when ok is false.
+func blockTarget(c *gin.Context) (userID, targetID uuid.UUID, ok bool) {
+	currentUserID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	targetID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	userID, _ = uuid.Parse(currentUserID.(string))
+	if userID == targetID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+		return
+	}
+
+	return userID, targetID, true
+}
+
+// BlockUserHandler blocks another user. Users who have blocked each other,
+// in either direction, cannot be put in a new chat together or join one
+// through an invite link.
+func BlockUserHandler(c *gin.Context) {
+	userUUID, targetUUID, ok := blockTarget(c)
+	if !ok {
+		return
+	}
+
+	result, err := db.DB().Exec(`
+		INSERT INTO user_blocks (blocker_id, blocked_id)
+		SELECT $1, id FROM users WHERE id = $2
+		ON CONFLICT DO NOTHING
+	`, userUUID, targetUUID)
+	if err != nil {
+		log.Printf("Error blocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	// Nothing was inserted either because the block exists already or
+	// because there is no such user.
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		err := db.DB().QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, targetUUID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// UnblockUserHandler lifts the caller's block on another user. Removing a
+// block that does not exist succeeds.
+func UnblockUserHandler(c *gin.Context) {
+	userUUID, targetUUID, ok := blockTarget(c)
+	if !ok {
+		return
+	}
+
+	_, err := db.DB().Exec(`
+		DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2
+	`, userUUID, targetUUID)
+	if err != nil {
+		log.Printf("Error unblocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetBlockedUsersHandler lists the users the caller has blocked, most recent
+// first.
+func GetBlockedUsersHandler(c *gin.Context) {
+	currentUserID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT u.id, u.username, u.display_name, u.profile_picture, u.created_at, u.updated_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC, u.id
+	`, currentUserID)
+
+	if err != nil {
+		log.Printf("Error getting blocked users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		var profilePicture sql.NullString
+		err := rows.Scan(&user.ID, &user.Username, &user.DisplayName,
+			&profilePicture, &user.CreatedAt, &user.UpdatedAt)
+
+		if err != nil {
+			log.Printf("Error scanning blocked user row: %v", err)
+			continue
+		}
+
+		if profilePicture.Valid {
+			user.ProfilePicture = profilePicture.String
+		}
+
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, users)
+}
@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"qrconnect-backend/db"
@@ -12,6 +16,19 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	ChatTypeGroup        = "group"
+	ChatTypeAnnouncement = "announcement"
+)
+
+const (
+	maxSlowModeSeconds  = 6 * 60 * 60
+	defaultChatPageSize = 30
+	maxChatPageSize     = 100
+	memberSummarySize   = 3
 )
 
 func GetChatsHandler(c *gin.Context) {
@@ -27,15 +44,81 @@ func GetChatsHandler(c *gin.Context) {
 		return
 	}
 
-	rows, err := db.DB().Query(`
-		SELECT c.id, c.name, c.is_secure, c.folder, c.last_message, c.last_message_at, 
-			   c.created_at, c.updated_at
+	limit := parseLimit(c, defaultChatPageSize, maxChatPageSize)
+
+	query := `
+		SELECT c.id, c.name, c.chat_type, c.is_secure, COALESCE(c.folder, ''), COALESCE(c.description, ''),
+			   COALESCE(c.topic, ''), COALESCE(c.avatar, ''), c.slow_mode_seconds,
+			   c.default_disappear_after, c.retention_days, c.last_message,
+			   c.last_message_at, c.created_at, c.updated_at, COALESCE(c.last_message_at, c.created_at) AS sort_at,
+			   (SELECT COUNT(*) FROM chat_members m WHERE m.chat_id = c.id) AS member_count,
+			   (SELECT COUNT(*) FROM messages um
+				WHERE um.chat_id = c.id AND um.sender_id != $1 AND um.deleted_at IS NULL
+				  AND NOT EXISTS (
+					SELECT 1 FROM message_receipts r
+					WHERE r.message_id = um.id AND r.user_id = $1 AND r.read_at IS NOT NULL)
+				  AND (cm.cleared_at IS NULL OR um.sent_at > cm.cleared_at)) AS unread_count
 		FROM chats c
 		JOIN chat_members cm ON c.id = cm.chat_id
 		WHERE cm.user_id = $1
-		ORDER BY c.last_message_at DESC NULLS LAST, c.updated_at DESC
-	`, userUUID)
+		  AND (cm.hidden_at IS NULL OR COALESCE(c.last_message_at, c.created_at) > cm.hidden_at)`
+	args := []interface{}{userUUID}
+	argIndex := 2
+
+	if name := strings.TrimSpace(c.Query("name")); name != "" {
+		query += fmt.Sprintf(" AND c.name ILIKE $%d", argIndex)
+		args = append(args, "%"+escapeLike(name)+"%")
+		argIndex++
+	}
+
+	if member := c.Query("member"); member != "" {
+		memberUUID, err := uuid.Parse(member)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+			return
+		}
+		query += fmt.Sprintf(` AND EXISTS (
+			SELECT 1 FROM chat_members fm WHERE fm.chat_id = c.id AND fm.user_id = $%d)`, argIndex)
+		args = append(args, memberUUID)
+		argIndex++
+	}
+
+	if chatType := c.Query("type"); chatType != "" {
+		query += fmt.Sprintf(" AND c.chat_type = $%d", argIndex)
+		args = append(args, chatType)
+		argIndex++
+	}
+
+	if folder, ok := c.GetQuery("folder"); ok {
+		query += fmt.Sprintf(" AND COALESCE(c.folder, '') = $%d", argIndex)
+		args = append(args, folder)
+		argIndex++
+	}
+
+	if c.Query("unread") == "true" {
+		query += ` AND EXISTS (
+			SELECT 1 FROM messages um WHERE um.chat_id = c.id AND um.sender_id != $1 AND um.deleted_at IS NULL
+				  AND NOT EXISTS (
+					SELECT 1 FROM message_receipts r
+					WHERE r.message_id = um.id AND r.user_id = $1 AND r.read_at IS NOT NULL)
+			AND (cm.cleared_at IS NULL OR um.sent_at > cm.cleared_at))`
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		cursorAt, cursorID, err := decodeCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query += fmt.Sprintf(" AND (COALESCE(c.last_message_at, c.created_at), c.id) < ($%d, $%d)", argIndex, argIndex+1)
+		args = append(args, cursorAt, cursorID)
+		argIndex += 2
+	}
+
+	query += fmt.Sprintf(" ORDER BY sort_at DESC, c.id DESC LIMIT $%d", argIndex)
+	args = append(args, limit+1)
 
+	rows, err := db.DB().Query(query, args...)
 	if err != nil {
 		log.Printf("Error getting chats: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -44,15 +127,20 @@ func GetChatsHandler(c *gin.Context) {
 	defer rows.Close()
 
 	chats := []models.Chat{}
+	var lastSortAt time.Time
 
 	for rows.Next() {
 		var chat models.Chat
 		var lastMessage sql.NullString
 		var lastMessageAt sql.NullTime
+		var sortAt time.Time
+		var avatar string
+		var defaultDisappearAfter sql.NullInt32
 
 		err := rows.Scan(
-			&chat.ID, &chat.Name, &chat.IsSecure, &chat.Folder,
-			&lastMessage, &lastMessageAt, &chat.CreatedAt, &chat.UpdatedAt,
+			&chat.ID, &chat.Name, &chat.Type, &chat.IsSecure, &chat.Folder, &chat.Description,
+			&chat.Topic, &avatar, &chat.SlowModeSeconds, &defaultDisappearAfter, &chat.RetentionDays,
+			&lastMessage, &lastMessageAt, &chat.CreatedAt, &chat.UpdatedAt, &sortAt, &chat.MemberCount, &chat.UnreadCount,
 		)
 
 		if err != nil {
@@ -68,17 +156,145 @@ func GetChatsHandler(c *gin.Context) {
 			chat.LastMessageAt = &lastMessageAt.Time
 		}
 
-		members, err := getChatMembers(chat.ID)
+		if avatar != "" {
+			chat.AvatarURL = chatAvatarURL(chat.ID)
+		}
+
+		chat.DefaultDisappearAfter = effectiveDisappearAfter(chat.IsSecure, defaultDisappearAfter)
+
+		if len(chats) == limit {
+			c.Header(NextCursorHeader, encodeCursor(lastSortAt, chats[len(chats)-1].ID))
+			break
+		}
+
+		lastSortAt = sortAt
+		chats = append(chats, chat)
+	}
+
+	if len(chats) == 0 {
+		c.JSON(http.StatusOK, chats)
+		return
+	}
+
+	chatIDs := make([]uuid.UUID, len(chats))
+	for i, chat := range chats {
+		chatIDs[i] = chat.ID
+	}
+
+	if c.Query("expand") == "members" {
+		members, err := getMembersForChats(chatIDs)
 		if err != nil {
 			log.Printf("Error getting chat members: %v", err)
+		}
+		for i := range chats {
+			chats[i].Members = members[chats[i].ID]
+		}
+	} else {
+		summaries, err := getMemberSummaries(chatIDs, userUUID)
+		if err != nil {
+			log.Printf("Error getting chat member summaries: %v", err)
+		}
+		for i := range chats {
+			chats[i].MemberSummary = summaries[chats[i].ID]
+		}
+	}
+
+	c.JSON(http.StatusOK, chats)
+}
+
+// getMembersForChats loads the full member lists of several chats in one query.
+func getMembersForChats(chatIDs []uuid.UUID) (map[uuid.UUID][]models.User, error) {
+	rows, err := db.DB().Query(`
+		SELECT cm.chat_id, u.id, u.username, u.display_name, u.profile_picture,
+			   cm.role, cm.joined_at
+		FROM users u
+		JOIN chat_members cm ON u.id = cm.user_id
+		WHERE cm.chat_id = ANY($1::uuid[])
+		ORDER BY cm.joined_at
+	`, pq.Array(uuidStrings(chatIDs)))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[uuid.UUID][]models.User, len(chatIDs))
+	for rows.Next() {
+		var chatID uuid.UUID
+		var member models.User
+		var role string
+		var joinedAt time.Time
+		var profilePicture sql.NullString
+
+		err := rows.Scan(
+			&chatID, &member.ID, &member.Username, &member.DisplayName, &profilePicture,
+			&role, &joinedAt,
+		)
+
+		if err != nil {
+			log.Printf("Error scanning member row: %v", err)
 			continue
 		}
 
-		chat.Members = members
-		chats = append(chats, chat)
+		if profilePicture.Valid {
+			member.ProfilePicture = profilePicture.String
+		}
+
+		member.Metadata = map[string]interface{}{
+			"role":     role,
+			"joinedAt": joinedAt,
+		}
+
+		members[chatID] = append(members[chatID], member)
 	}
 
-	c.JSON(http.StatusOK, chats)
+	return members, rows.Err()
+}
+
+// getMemberSummaries returns up to memberSummarySize members other than the
+// requesting user for each chat, oldest members first.
+func getMemberSummaries(chatIDs []uuid.UUID, userID uuid.UUID) (map[uuid.UUID][]models.MemberSummary, error) {
+	rows, err := db.DB().Query(`
+		SELECT chat_id, id, username, display_name, profile_picture
+		FROM (
+			SELECT cm.chat_id, u.id, u.username, u.display_name, u.profile_picture,
+				   ROW_NUMBER() OVER (PARTITION BY cm.chat_id ORDER BY cm.joined_at, u.id) AS rn
+			FROM users u
+			JOIN chat_members cm ON u.id = cm.user_id
+			WHERE cm.chat_id = ANY($1::uuid[]) AND cm.user_id != $2
+		) ranked
+		WHERE rn <= $3
+		ORDER BY chat_id, rn
+	`, pq.Array(uuidStrings(chatIDs)), userID, memberSummarySize)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make(map[uuid.UUID][]models.MemberSummary, len(chatIDs))
+	for rows.Next() {
+		var chatID uuid.UUID
+		var summary models.MemberSummary
+		var profilePicture sql.NullString
+
+		if err := rows.Scan(&chatID, &summary.ID, &summary.Username, &summary.DisplayName, &profilePicture); err != nil {
+			log.Printf("Error scanning member summary row: %v", err)
+			continue
+		}
+
+		if profilePicture.Valid {
+			summary.ProfilePicture = profilePicture.String
+		}
+
+		summaries[chatID] = append(summaries[chatID], summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
 
 func GetChatHandler(c *gin.Context) {
@@ -114,19 +330,7 @@ func GetChatHandler(c *gin.Context) {
 		return
 	}
 
-	var chat models.Chat
-	var lastMessage sql.NullString
-	var lastMessageAt sql.NullTime
-
-	err = db.DB().QueryRow(`
-		SELECT id, name, is_secure, folder, last_message, last_message_at, created_at, updated_at
-		FROM chats
-		WHERE id = $1
-	`, chatUUID).Scan(
-		&chat.ID, &chat.Name, &chat.IsSecure, &chat.Folder,
-		&lastMessage, &lastMessageAt, &chat.CreatedAt, &chat.UpdatedAt,
-	)
-
+	chat, err := getChatByID(db.DB(), chatUUID, false)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
 		return
@@ -136,14 +340,6 @@ func GetChatHandler(c *gin.Context) {
 		return
 	}
 
-	if lastMessage.Valid {
-		chat.LastMessage = lastMessage.String
-	}
-
-	if lastMessageAt.Valid {
-		chat.LastMessageAt = &lastMessageAt.Time
-	}
-
 	members, err := getChatMembersSafely(chat.ID)
 	if err != nil {
 		log.Printf("Error getting chat members: %v", err)
@@ -200,6 +396,12 @@ func getChatMembersSafely(chatID uuid.UUID) ([]models.User, error) {
 
 	return members, nil
 }
+
+type memberProblem struct {
+	MemberID string `json:"memberId"`
+	Reason   string `json:"reason"`
+}
+
 func CreateChatHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -209,6 +411,7 @@ func CreateChatHandler(c *gin.Context) {
 
 	var req struct {
 		Name      string   `json:"name" binding:"required"`
+		Type      string   `json:"type"`
 		IsSecure  bool     `json:"isSecure"`
 		Folder    string   `json:"folder"`
 		MemberIDs []string `json:"memberIds" binding:"required"`
@@ -219,66 +422,118 @@ func CreateChatHandler(c *gin.Context) {
 		return
 	}
 
+	if req.Type == "" {
+		req.Type = ChatTypeGroup
+	}
+	if !validChatType(req.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be 'group' or 'announcement'"})
+		return
+	}
+
 	if len(req.MemberIDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one member is required"})
 		return
 	}
 
-	currentUserID := userID.(string)
-	found := false
-	for _, id := range req.MemberIDs {
-		if id == currentUserID {
-			found = true
-			break
+	creatorUUID, err := uuid.Parse(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	problems := []memberProblem{}
+	seen := make(map[uuid.UUID]bool, len(req.MemberIDs))
+	memberUUIDs := []uuid.UUID{}
+
+	for _, memberID := range req.MemberIDs {
+		memberUUID, err := uuid.Parse(memberID)
+		if err != nil {
+			problems = append(problems, memberProblem{MemberID: memberID, Reason: "invalid_id"})
+			continue
 		}
+
+		if seen[memberUUID] {
+			problems = append(problems, memberProblem{MemberID: memberID, Reason: "duplicate"})
+			continue
+		}
+		seen[memberUUID] = true
+
+		if memberUUID != creatorUUID {
+			memberUUIDs = append(memberUUIDs, memberUUID)
+		}
+	}
+
+	if limit := maxChatSize(req.Type); len(memberUUIDs)+1 > limit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A chat can have at most %d members", limit)})
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	if len(memberUUIDs) > 0 {
+		memberProblems, err := validateChatMembers(tx, creatorUUID, memberUUIDs)
+		if err != nil {
+			log.Printf("Error validating chat members: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		problems = append(problems, memberProblems...)
 	}
-	if !found {
-		req.MemberIDs = append(req.MemberIDs, currentUserID)
+
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid members", "problems": problems})
+		return
 	}
 
 	chatID := uuid.New()
-	_, err := db.DB().Exec(`
-		INSERT INTO chats (id, name, is_secure, folder)
-		VALUES ($1, $2, $3, $4)
-	`, chatID, req.Name, req.IsSecure, req.Folder)
+	_, err = tx.Exec(`
+		INSERT INTO chats (id, name, chat_type, is_secure, folder)
+		VALUES ($1, $2, $3, $4, $5)
+	`, chatID, req.Name, req.Type, req.IsSecure, req.Folder)
 
 	if err != nil {
 		log.Printf("Error creating chat: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
 		return
 	}
-	for _, memberID := range req.MemberIDs {
-		memberUUID, err := uuid.Parse(memberID)
-		if err != nil {
-			log.Printf("Invalid member ID %s: %v", memberID, err)
-			continue
-		}
 
-		role := "member"
-		if memberID == currentUserID {
-			role = "admin"
-		}
+	_, err = tx.Exec(`
+		INSERT INTO chat_members (chat_id, user_id, role)
+		VALUES ($1, $2, 'admin')
+	`, chatID, creatorUUID)
+
+	if err != nil {
+		log.Printf("Error adding creator to chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
+		return
+	}
 
-		_, err = db.DB().Exec(`
+	if len(memberUUIDs) > 0 {
+		_, err = tx.Exec(`
 			INSERT INTO chat_members (chat_id, user_id, role)
-			VALUES ($1, $2, $3)
-		`, chatID, memberUUID, role)
+			SELECT $1, unnest($2::uuid[]), 'member'
+		`, chatID, pq.Array(uuidStrings(memberUUIDs)))
 
 		if err != nil {
-			log.Printf("Error adding member %s to chat: %v", memberID, err)
+			log.Printf("Error adding members to chat: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
+			return
 		}
 	}
 
-	var chat models.Chat
-	err = db.DB().QueryRow(`
-		SELECT id, name, is_secure, folder, created_at, updated_at
-		FROM chats
-		WHERE id = $1
-	`, chatID).Scan(
-		&chat.ID, &chat.Name, &chat.IsSecure, &chat.Folder,
-		&chat.CreatedAt, &chat.UpdatedAt,
-	)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
+		return
+	}
 
+	chat, err := getChatByID(db.DB(), chatID, false)
 	if err != nil {
 		log.Printf("Error getting created chat: %v", err)
 		c.JSON(http.StatusCreated, gin.H{"id": chatID})
@@ -290,11 +545,72 @@ func CreateChatHandler(c *gin.Context) {
 		log.Printf("Error getting chat members: %v", err)
 	} else {
 		chat.Members = members
+		chat.MemberCount = len(members)
 	}
 
+	go func() {
+		wsMessage := WSMessage{
+			Type: ChatCreatedType,
+			Payload: map[string]interface{}{
+				"chat":      chat,
+				"createdBy": creatorUUID.String(),
+			},
+		}
+		SendToUser(creatorUUID.String(), wsMessage)
+		for _, memberUUID := range memberUUIDs {
+			SendToUser(memberUUID.String(), wsMessage)
+		}
+	}()
+
 	c.JSON(http.StatusCreated, chat)
 }
 
+// validateChatMembers reports members that do not exist or that have a block
+// in either direction with the creator.
+func validateChatMembers(tx *sql.Tx, creatorID uuid.UUID, memberIDs []uuid.UUID) ([]memberProblem, error) {
+	rows, err := tx.Query(`
+		SELECT u.id,
+			   EXISTS (
+				   SELECT 1 FROM user_blocks b
+				   WHERE (b.blocker_id = u.id AND b.blocked_id = $2)
+					  OR (b.blocker_id = $2 AND b.blocked_id = u.id)
+			   ) AS blocked
+		FROM users u
+		WHERE u.id = ANY($1::uuid[])
+	`, pq.Array(uuidStrings(memberIDs)), creatorID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := make(map[uuid.UUID]bool, len(memberIDs))
+	for rows.Next() {
+		var id uuid.UUID
+		var isBlocked bool
+		if err := rows.Scan(&id, &isBlocked); err != nil {
+			return nil, err
+		}
+		blocked[id] = isBlocked
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	problems := []memberProblem{}
+	for _, id := range memberIDs {
+		isBlocked, known := blocked[id]
+		switch {
+		case !known:
+			problems = append(problems, memberProblem{MemberID: id.String(), Reason: "unknown_user"})
+		case isBlocked:
+			problems = append(problems, memberProblem{MemberID: id.String(), Reason: "blocked"})
+		}
+	}
+
+	return problems, nil
+}
+
 func UpdateChatHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -323,9 +639,15 @@ func UpdateChatHandler(c *gin.Context) {
 	}
 
 	var req struct {
-		Name     *string `json:"name"`
-		IsSecure *bool   `json:"isSecure"`
-		Folder   *string `json:"folder"`
+		Name                  *string `json:"name"`
+		Type                  *string `json:"type"`
+		IsSecure              *bool   `json:"isSecure"`
+		Folder                *string `json:"folder"`
+		Description           *string `json:"description"`
+		Topic                 *string `json:"topic"`
+		SlowModeSeconds       *int    `json:"slowModeSeconds"`
+		DefaultDisappearAfter *int    `json:"defaultDisappearAfter"`
+		RetentionDays         *int    `json:"retentionDays"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -333,21 +655,116 @@ func UpdateChatHandler(c *gin.Context) {
 		return
 	}
 
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+		return
+	}
+
+	if req.Type != nil && !validChatType(*req.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be 'group' or 'announcement'"})
+		return
+	}
+
+	if req.Description != nil && len(*req.Description) > maxChatDescriptionLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Description cannot exceed %d characters", maxChatDescriptionLength)})
+		return
+	}
+
+	if req.Topic != nil && len(*req.Topic) > maxChatTopicLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Topic cannot exceed %d characters", maxChatTopicLength)})
+		return
+	}
+
+	if req.SlowModeSeconds != nil && (*req.SlowModeSeconds < 0 || *req.SlowModeSeconds > maxSlowModeSeconds) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("slowModeSeconds must be between 0 and %d", maxSlowModeSeconds)})
+		return
+	}
+
+	if req.RetentionDays != nil && (*req.RetentionDays < 0 || *req.RetentionDays > maxRetentionDays) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("retentionDays must be between 0 and %d", maxRetentionDays)})
+		return
+	}
+
+	if req.DefaultDisappearAfter != nil && *req.DefaultDisappearAfter < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "defaultDisappearAfter cannot be negative"})
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := getChatByID(tx, chatUUID, true)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
 	query := "UPDATE chats SET "
 	args := []interface{}{}
 	argIndex := 1
 	updates := []string{}
+	changes := []chatChange{}
 
 	if req.Name != nil {
 		updates = append(updates, fmt.Sprintf("name = $%d", argIndex))
 		args = append(args, *req.Name)
 		argIndex++
+		if *req.Name != current.Name {
+			changes = append(changes, chatChange{Field: "name", OldValue: current.Name, NewValue: *req.Name})
+		}
+	}
+
+	if req.Type != nil {
+		updates = append(updates, fmt.Sprintf("chat_type = $%d", argIndex))
+		args = append(args, *req.Type)
+		argIndex++
+		if *req.Type != current.Type {
+			changes = append(changes, chatChange{Field: "type", OldValue: current.Type, NewValue: *req.Type})
+		}
 	}
 
 	if req.IsSecure != nil {
 		updates = append(updates, fmt.Sprintf("is_secure = $%d", argIndex))
 		args = append(args, *req.IsSecure)
 		argIndex++
+		if *req.IsSecure != current.IsSecure {
+			// Downgrading a secure chat always produces a system notice
+			// through recordChatChanges, so no member misses it.
+			changes = append(changes, chatChange{
+				Field:    "isSecure",
+				OldValue: strconv.FormatBool(current.IsSecure),
+				NewValue: strconv.FormatBool(*req.IsSecure),
+			})
+			if *req.IsSecure {
+				updates = append(updates, "last_message = NULL")
+			} else {
+				// Messages sent so far are ciphertext and must never be
+				// indexed for search.
+				updates = append(updates, "secure_until = NOW()")
+			}
+		}
+	}
+
+	if req.DefaultDisappearAfter != nil {
+		updates = append(updates, fmt.Sprintf("default_disappear_after = $%d", argIndex))
+		args = append(args, *req.DefaultDisappearAfter)
+		argIndex++
+		if *req.DefaultDisappearAfter != current.DefaultDisappearAfter {
+			changes = append(changes, chatChange{
+				Field:    "defaultDisappearAfter",
+				OldValue: strconv.Itoa(current.DefaultDisappearAfter),
+				NewValue: strconv.Itoa(*req.DefaultDisappearAfter),
+			})
+		}
 	}
 
 	if req.Folder != nil {
@@ -356,6 +773,50 @@ func UpdateChatHandler(c *gin.Context) {
 		argIndex++
 	}
 
+	if req.Description != nil {
+		updates = append(updates, fmt.Sprintf("description = $%d", argIndex))
+		args = append(args, *req.Description)
+		argIndex++
+		if *req.Description != current.Description {
+			changes = append(changes, chatChange{Field: "description", OldValue: current.Description, NewValue: *req.Description})
+		}
+	}
+
+	if req.Topic != nil {
+		updates = append(updates, fmt.Sprintf("topic = $%d", argIndex))
+		args = append(args, *req.Topic)
+		argIndex++
+		if *req.Topic != current.Topic {
+			changes = append(changes, chatChange{Field: "topic", OldValue: current.Topic, NewValue: *req.Topic})
+		}
+	}
+
+	if req.SlowModeSeconds != nil {
+		updates = append(updates, fmt.Sprintf("slow_mode_seconds = $%d", argIndex))
+		args = append(args, *req.SlowModeSeconds)
+		argIndex++
+		if *req.SlowModeSeconds != current.SlowModeSeconds {
+			changes = append(changes, chatChange{
+				Field:    "slowModeSeconds",
+				OldValue: strconv.Itoa(current.SlowModeSeconds),
+				NewValue: strconv.Itoa(*req.SlowModeSeconds),
+			})
+		}
+	}
+
+	if req.RetentionDays != nil {
+		updates = append(updates, fmt.Sprintf("retention_days = $%d", argIndex))
+		args = append(args, *req.RetentionDays)
+		argIndex++
+		if *req.RetentionDays != current.RetentionDays {
+			changes = append(changes, chatChange{
+				Field:    "retentionDays",
+				OldValue: strconv.Itoa(current.RetentionDays),
+				NewValue: strconv.Itoa(*req.RetentionDays),
+			})
+		}
+	}
+
 	if len(updates) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
@@ -373,38 +834,45 @@ func UpdateChatHandler(c *gin.Context) {
 	query += fmt.Sprintf(" WHERE id = $%d", argIndex)
 	args = append(args, chatUUID)
 
-	_, err = db.DB().Exec(query, args...)
+	_, err = tx.Exec(query, args...)
 	if err != nil {
 		log.Printf("Error updating chat: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
 		return
 	}
 
-	var chat models.Chat
-	var lastMessage sql.NullString
-	var lastMessageAt sql.NullTime
-
-	err = db.DB().QueryRow(`
-		SELECT id, name, is_secure, folder, last_message, last_message_at, created_at, updated_at
-		FROM chats
-		WHERE id = $1
-	`, chatUUID).Scan(
-		&chat.ID, &chat.Name, &chat.IsSecure, &chat.Folder,
-		&lastMessage, &lastMessageAt, &chat.CreatedAt, &chat.UpdatedAt,
-	)
+	// The search trigger only runs when a message changes, so the chat's
+	// existing plaintext has to be taken out of the index here.
+	if req.IsSecure != nil && *req.IsSecure && !current.IsSecure {
+		_, err = tx.Exec(`
+			UPDATE messages SET search_vector = NULL
+			WHERE chat_id = $1 AND search_vector IS NOT NULL
+		`, chatUUID)
+		if err != nil {
+			log.Printf("Error removing chat from search index: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+			return
+		}
+	}
 
+	systemMessages, err := recordChatChanges(tx, chatUUID, userUUID, changes)
 	if err != nil {
-		log.Printf("Error getting updated chat: %v", err)
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		log.Printf("Error recording chat changes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
 		return
 	}
 
-	if lastMessage.Valid {
-		chat.LastMessage = lastMessage.String
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
 	}
 
-	if lastMessageAt.Valid {
-		chat.LastMessageAt = &lastMessageAt.Time
+	chat, err := getChatByID(db.DB(), chatUUID, false)
+	if err != nil {
+		log.Printf("Error getting updated chat: %v", err)
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
 	}
 
 	members, err := getChatMembers(chat.ID)
@@ -412,6 +880,8 @@ func UpdateChatHandler(c *gin.Context) {
 		chat.Members = members
 	}
 
+	go broadcastChatUpdate(chat, changes, systemMessages)
+
 	c.JSON(http.StatusOK, chat)
 }
 
@@ -437,19 +907,217 @@ func DeleteChatHandler(c *gin.Context) {
 		WHERE chat_id = $1 AND user_id = $2
 	`, chatUUID, userUUID).Scan(&role)
 
-	if err != nil || role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can delete chat"})
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
 		return
+	} else if err != nil {
+		log.Printf("Error checking chat membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	switch c.DefaultQuery("scope", "everyone") {
+	case "me":
+		hideChatForMember(c, chatUUID, userUUID)
+	case "everyone":
+		if role != "admin" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can delete chat"})
+			return
+		}
+		deleteChatForEveryone(c, chatUUID, userUUID)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be 'me' or 'everyone'"})
+	}
+}
+
+// hideChatForMember removes the chat from the member's list until a newer
+// message arrives. With clearHistory=true it also hides every message sent up
+// to "before" (default now) from that member's history view.
+func hideChatForMember(c *gin.Context, chatUUID, userUUID uuid.UUID) {
+	now := time.Now()
+	clearedAt := sql.NullTime{}
+
+	if c.Query("clearHistory") == "true" {
+		clearedAt = sql.NullTime{Time: now, Valid: true}
+		if before := c.Query("before"); before != "" {
+			t, err := time.Parse(time.RFC3339, before)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "before must be an RFC 3339 timestamp"})
+				return
+			}
+			if t.After(now) {
+				t = now
+			}
+			clearedAt.Time = t
+		}
 	}
 
-	_, err = db.DB().Exec(`DELETE FROM chats WHERE id = $1`, chatUUID)
+	_, err := db.DB().Exec(`
+		UPDATE chat_members
+		SET hidden_at = $1, cleared_at = COALESCE($2, cleared_at)
+		WHERE chat_id = $3 AND user_id = $4
+	`, now, clearedAt, chatUUID, userUUID)
+
 	if err != nil {
+		log.Printf("Error hiding chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
+		return
+	}
+
+	response := gin.H{"success": true, "scope": "me"}
+	if clearedAt.Valid {
+		response["clearedAt"] = clearedAt.Time
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func deleteChatForEveryone(c *gin.Context, chatUUID, userUUID uuid.UUID) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	memberIDs, err := getChatMemberIDs(tx, chatUUID)
+	if err != nil {
+		log.Printf("Error getting chat members: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
+		return
+	}
+
+	var avatar sql.NullString
+	err = tx.QueryRow(`SELECT avatar FROM chats WHERE id = $1`, chatUUID).Scan(&avatar)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting chat avatar: %v", err)
+	}
+
+	if err := deleteChatRows(tx, chatUUID); err != nil {
 		log.Printf("Error deleting chat: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
+		return
+	}
+
+	invalidateChatMembers(chatUUID)
+
+	if avatar.Valid && avatar.String != "" {
+		os.Remove(filepath.Join(uploadDir(), filepath.FromSlash(avatar.String)))
+	}
+
+	go SendToUsers(memberIDs, WSMessage{
+		Type: ChatDeleteType,
+		Payload: map[string]interface{}{
+			"chatId":    chatUUID.String(),
+			"deletedBy": userUUID.String(),
+		},
+	}, "")
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "scope": "everyone"})
+}
+
+// deleteChatRows removes a chat together with everything that hangs off it.
+// Tables are cleared explicitly, children first, so nothing is left behind
+// even where a foreign key lacks ON DELETE CASCADE.
+func deleteChatRows(tx *sql.Tx, chatID uuid.UUID) error {
+	queries := []string{
+		`DELETE FROM chat_edits WHERE chat_id = $1`,
+		`DELETE FROM chat_join_requests WHERE chat_id = $1`,
+		`DELETE FROM chat_invites WHERE chat_id = $1`,
+		`UPDATE attachments SET chat_id = NULL, message_id = NULL WHERE chat_id = $1`,
+		`DELETE FROM messages WHERE chat_id = $1`,
+		`DELETE FROM chat_members WHERE chat_id = $1`,
+		`DELETE FROM chats WHERE id = $1`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getChatMemberIDs(q queryer, chatID uuid.UUID) ([]string, error) {
+	rows, err := q.Query(`SELECT user_id FROM chat_members WHERE chat_id = $1`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberIDs := []string{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		memberIDs = append(memberIDs, id.String())
+	}
+
+	return memberIDs, rows.Err()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func validChatType(chatType string) bool {
+	return chatType == ChatTypeGroup || chatType == ChatTypeAnnouncement
+}
+
+// getChatByID loads a single chat. With forUpdate the row is locked for the
+// rest of the caller's transaction.
+func getChatByID(q queryer, chatID uuid.UUID, forUpdate bool) (models.Chat, error) {
+	query := `
+		SELECT id, name, chat_type, is_secure, COALESCE(folder, ''), COALESCE(description, ''),
+			   COALESCE(topic, ''), COALESCE(avatar, ''), slow_mode_seconds, default_disappear_after,
+			   retention_days, last_message, last_message_at, created_at, updated_at
+		FROM chats
+		WHERE id = $1`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var chat models.Chat
+	var avatar string
+	var defaultDisappearAfter sql.NullInt32
+	var lastMessage sql.NullString
+	var lastMessageAt sql.NullTime
+
+	err := q.QueryRow(query, chatID).Scan(
+		&chat.ID, &chat.Name, &chat.Type, &chat.IsSecure, &chat.Folder, &chat.Description,
+		&chat.Topic, &avatar, &chat.SlowModeSeconds, &defaultDisappearAfter, &chat.RetentionDays,
+		&lastMessage, &lastMessageAt, &chat.CreatedAt, &chat.UpdatedAt,
+	)
+	if err != nil {
+		return chat, err
+	}
+
+	if lastMessage.Valid {
+		chat.LastMessage = lastMessage.String
+	}
+
+	if lastMessageAt.Valid {
+		chat.LastMessageAt = &lastMessageAt.Time
+	}
+
+	if avatar != "" {
+		chat.AvatarURL = chatAvatarURL(chat.ID)
+	}
+
+	chat.DefaultDisappearAfter = effectiveDisappearAfter(chat.IsSecure, defaultDisappearAfter)
+
+	return chat, nil
 }
 
 func getChatMembers(chatID uuid.UUID) ([]models.User, error) {
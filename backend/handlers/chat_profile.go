@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxChatDescriptionLength = 1000
+	maxChatTopicLength       = 255
+)
+
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// chatChange describes one field of a chat changing value. Every change is
+// written to chat_edits and announced with a system message.
+type chatChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
+
+func chatAvatarURL(chatID uuid.UUID) string {
+	return "/api/chats/" + chatID.String() + "/avatar"
+}
+
+// publicChatChange replaces the storage keys in an avatar change with the URL
+// clients load the avatar from. Replaced avatars are not kept, so any set
+// value maps to the chat's avatar URL.
+func publicChatChange(chatID uuid.UUID, change chatChange) chatChange {
+	if change.Field != "avatar" {
+		return change
+	}
+	if change.OldValue != "" {
+		change.OldValue = chatAvatarURL(chatID)
+	}
+	if change.NewValue != "" {
+		change.NewValue = chatAvatarURL(chatID)
+	}
+	return change
+}
+
+func uploadDir() string {
+	dir := os.Getenv("UPLOAD_DIR")
+	if dir == "" {
+		dir = "data/uploads"
+	}
+	return dir
+}
+
+func getMemberRole(q queryer, chatID, userID uuid.UUID) (string, error) {
+	var role string
+	err := q.QueryRow(`
+		SELECT role FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatID, userID).Scan(&role)
+	return role, err
+}
+
+func isAdminRole(role string) bool {
+	return role == "admin" || role == "owner"
+}
+
+// recordChatChanges stores the edit history for changes and creates one
+// system message per change. It must run in the same transaction as the
+// update itself.
+func recordChatChanges(tx *sql.Tx, chatID, actorID uuid.UUID, changes []chatChange) ([]models.Message, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	var actorName string
+	err := tx.QueryRow(`SELECT display_name FROM users WHERE id = $1`, actorID).Scan(&actorName)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	for _, change := range changes {
+		_, err := tx.Exec(`
+			INSERT INTO chat_edits (id, chat_id, field, old_value, new_value, edited_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, uuid.New(), chatID, change.Field, change.OldValue, change.NewValue, actorID)
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := insertSystemMessage(tx, chatID, actorID, describeChatChange(actorName, change))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func describeChatChange(actorName string, change chatChange) string {
+	switch change.Field {
+	case "name":
+		return fmt.Sprintf("%s renamed the chat to %q", actorName, change.NewValue)
+	case "description":
+		if change.NewValue == "" {
+			return fmt.Sprintf("%s removed the chat description", actorName)
+		}
+		return fmt.Sprintf("%s updated the chat description", actorName)
+	case "topic":
+		if change.NewValue == "" {
+			return fmt.Sprintf("%s cleared the topic", actorName)
+		}
+		return fmt.Sprintf("%s changed the topic to %q", actorName, change.NewValue)
+	case "type":
+		if change.NewValue == ChatTypeAnnouncement {
+			return fmt.Sprintf("%s made this an announcement channel where only admins can post", actorName)
+		}
+		return fmt.Sprintf("%s opened the chat for everyone to post", actorName)
+	case "slowModeSeconds":
+		if change.NewValue == "0" {
+			return fmt.Sprintf("%s turned off slow mode", actorName)
+		}
+		return fmt.Sprintf("%s turned on slow mode: one message every %s seconds", actorName, change.NewValue)
+	case "isSecure":
+		if change.NewValue == "false" {
+			return fmt.Sprintf("%s turned off end-to-end security for this chat. New messages may be stored unencrypted", actorName)
+		}
+		return fmt.Sprintf("%s made this chat secure. Messages must now be end-to-end encrypted", actorName)
+	case "defaultDisappearAfter":
+		if change.NewValue == "0" {
+			return fmt.Sprintf("%s turned off disappearing messages", actorName)
+		}
+		return fmt.Sprintf("%s set messages to disappear after %s seconds", actorName, change.NewValue)
+	case "retentionDays":
+		if change.NewValue == "0" {
+			return fmt.Sprintf("%s turned off automatic message deletion", actorName)
+		}
+		return fmt.Sprintf("%s set messages to be deleted after %s days", actorName, change.NewValue)
+	case "avatar":
+		if change.NewValue == "" {
+			return fmt.Sprintf("%s removed the chat photo", actorName)
+		}
+		return fmt.Sprintf("%s changed the chat photo", actorName)
+	default:
+		return fmt.Sprintf("%s changed the chat settings", actorName)
+	}
+}
+
+// broadcastChatUpdate sends chat_update, followed by any system messages the
+// update produced, to every member of the chat.
+func broadcastChatUpdate(chat models.Chat, changes []chatChange, systemMessages []models.Message) {
+	memberIDs, err := getChatMemberIDs(db.DB(), chat.ID)
+	if err != nil {
+		log.Printf("Error getting chat members: %v", err)
+		return
+	}
+
+	public := make([]chatChange, len(changes))
+	for i, change := range changes {
+		public[i] = publicChatChange(chat.ID, change)
+	}
+
+	SendToUsers(memberIDs, WSMessage{
+		Type: ChatUpdateType,
+		Payload: map[string]interface{}{
+			"chatId":  chat.ID.String(),
+			"chat":    chat,
+			"changes": public,
+			"members": memberIDs,
+		},
+	}, "")
+
+	for _, message := range systemMessages {
+		SendToUsers(memberIDs, WSMessage{
+			Type: NewMessageType,
+			Payload: map[string]interface{}{
+				"message": message,
+				"chatId":  chat.ID.String(),
+			},
+		}, "")
+	}
+}
+
+func UploadChatAvatarHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can update chat"})
+		return
+	}
+
+	maxBytes := int64(envInt("CHAT_AVATAR_MAX_BYTES", 2<<20))
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64<<10)
+
+	file, header, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An avatar file is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar cannot exceed %d bytes", maxBytes)})
+		return
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+		return
+	}
+	sniff = sniff[:n]
+
+	ext, ok := avatarExtensions[http.DetectContentType(sniff)]
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Avatar must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	key := "avatars/" + chatUUID.String() + "-" + uuid.New().String() + ext
+	path := filepath.Join(uploadDir(), key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Error creating avatar directory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		log.Printf("Error creating avatar file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	_, err = io.Copy(out, io.MultiReader(bytes.NewReader(sniff), file))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		log.Printf("Error writing avatar file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	oldKey, chat, systemMessages, err := setChatAvatar(chatUUID, userUUID, key)
+	if err != nil {
+		os.Remove(path)
+		log.Printf("Error updating chat avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+
+	if oldKey != "" {
+		os.Remove(filepath.Join(uploadDir(), filepath.FromSlash(oldKey)))
+	}
+
+	go broadcastChatUpdate(chat, []chatChange{{Field: "avatar", OldValue: oldKey, NewValue: key}}, systemMessages)
+
+	c.JSON(http.StatusOK, chat)
+}
+
+func DeleteChatAvatarHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can update chat"})
+		return
+	}
+
+	oldKey, chat, systemMessages, err := setChatAvatar(chatUUID, userUUID, "")
+	if err != nil {
+		log.Printf("Error removing chat avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+
+	if oldKey != "" {
+		os.Remove(filepath.Join(uploadDir(), filepath.FromSlash(oldKey)))
+		go broadcastChatUpdate(chat, []chatChange{{Field: "avatar", OldValue: oldKey}}, systemMessages)
+	}
+
+	c.JSON(http.StatusOK, chat)
+}
+
+// setChatAvatar swaps the chat's avatar key and records the change, returning
+// the previous key so the caller can remove the old file.
+func setChatAvatar(chatID, actorID uuid.UUID, key string) (string, models.Chat, []models.Message, error) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return "", models.Chat{}, nil, err
+	}
+	defer tx.Rollback()
+
+	var oldKey string
+	err = tx.QueryRow(`SELECT COALESCE(avatar, '') FROM chats WHERE id = $1 FOR UPDATE`, chatID).Scan(&oldKey)
+	if err != nil {
+		return "", models.Chat{}, nil, err
+	}
+
+	if oldKey == key {
+		chat, err := getChatByID(tx, chatID, false)
+		return "", chat, nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE chats
+		SET avatar = NULLIF($1, ''), updated_at = NOW()
+		WHERE id = $2
+	`, key, chatID)
+	if err != nil {
+		return "", models.Chat{}, nil, err
+	}
+
+	systemMessages, err := recordChatChanges(tx, chatID, actorID, []chatChange{
+		{Field: "avatar", OldValue: oldKey, NewValue: key},
+	})
+	if err != nil {
+		return "", models.Chat{}, nil, err
+	}
+
+	chat, err := getChatByID(tx, chatID, false)
+	if err != nil {
+		return "", models.Chat{}, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", models.Chat{}, nil, err
+	}
+
+	return oldKey, chat, systemMessages, nil
+}
+
+func GetChatAvatarHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	if _, err := getMemberRole(db.DB(), chatUUID, userUUID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	var key sql.NullString
+	err = db.DB().QueryRow(`SELECT avatar FROM chats WHERE id = $1`, chatUUID).Scan(&key)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting chat avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !key.Valid || key.String == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat has no avatar"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.File(filepath.Join(uploadDir(), filepath.FromSlash(key.String)))
+}
+
+func GetChatEditHistoryHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	if _, err := getMemberRole(db.DB(), chatUUID, userUUID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT id, chat_id, field, COALESCE(old_value, ''), COALESCE(new_value, ''), edited_by, edited_at
+		FROM chat_edits
+		WHERE chat_id = $1 AND ($2 = '' OR field = $2)
+		ORDER BY edited_at DESC
+		LIMIT $3
+	`, chatUUID, c.Query("field"), parseLimit(c, 50, 200))
+
+	if err != nil {
+		log.Printf("Error getting chat edit history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	edits := []models.ChatEdit{}
+	for rows.Next() {
+		var edit models.ChatEdit
+		var change chatChange
+		var editedBy uuid.NullUUID
+		err := rows.Scan(
+			&edit.ID, &edit.ChatID, &change.Field, &change.OldValue, &change.NewValue,
+			&editedBy, &edit.EditedAt,
+		)
+		if err != nil {
+			log.Printf("Error scanning chat edit row: %v", err)
+			continue
+		}
+
+		// The editor may have deleted their account since.
+		if editedBy.Valid {
+			edit.EditedBy = &editedBy.UUID
+		}
+
+		change = publicChatChange(edit.ChatID, change)
+		edit.Field, edit.OldValue, edit.NewValue = change.Field, change.OldValue, change.NewValue
+		edits = append(edits, edit)
+	}
+
+	c.JSON(http.StatusOK, edits)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads an integer setting from the environment. Settings are read on
+// use rather than at package init so values loaded from .env are picked up.
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Error parsing %s: %v, using default value of %d", key, err, def)
+		return def
+	}
+
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Error parsing %s: %v, using default value of %v", key, err, def)
+		return def
+	}
+
+	return d
+}
+
+// messageEditWindow is how long after sending a message its sender may still
+// edit it. Zero or a negative value removes the limit.
+func messageEditWindow() time.Duration {
+	return envDuration("MESSAGE_EDIT_WINDOW", 48*time.Hour)
+}
+
+// messageDeleteWindow is how long after sending a message its sender may
+// still delete it for everyone. Chat admins are not limited. Zero or a
+// negative value removes the limit.
+func messageDeleteWindow() time.Duration {
+	return envDuration("MESSAGE_DELETE_WINDOW", 48*time.Hour)
+}
+
+// maxChatSize is the member limit for a new chat of the given type.
+// Announcement channels are read-mostly and allow far larger audiences.
+func maxChatSize(chatType string) int {
+	if chatType == ChatTypeAnnouncement {
+		return envInt("MAX_CHANNEL_SIZE", 100000)
+	}
+	return envInt("MAX_GROUP_SIZE", 256)
+}
+
+// maxPinnedMessages is how many messages a chat may have pinned at once.
+func maxPinnedMessages() int {
+	return envInt("MAX_PINNED_MESSAGES", 50)
+}
+
+// maxMentionAllMembers is the largest chat in which @all notifies everyone.
+// Above it, as in big announcement channels, @all is left as plain text.
+func maxMentionAllMembers() int {
+	return envInt("MENTION_ALL_MAX_MEMBERS", 256)
+}
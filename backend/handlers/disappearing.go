@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	"qrconnect-backend/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Disappearing messages count down either from when they were sent or, per
+// recipient, from when that recipient first read them.
+const (
+	DisappearFromSent = "sent"
+	DisappearFromRead = "read"
+)
+
+// disappearingMetrics is published at /debug/vars under "disappearing".
+var disappearingMetrics = expvar.NewMap("disappearing")
+
+// startReadTimers starts the per-recipient countdown for the read-mode
+// messages among messageIDs that the viewer has just read, and returns each
+// one's expiry as seen by that viewer. Timers that are already running are
+// left untouched.
+func startReadTimers(q queryer, viewerID uuid.UUID, messageIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	expiries := map[uuid.UUID]time.Time{}
+	if len(messageIDs) == 0 {
+		return expiries, nil
+	}
+
+	// The no-op DO UPDATE makes RETURNING include timers that already existed.
+	rows, err := q.Query(`
+		INSERT INTO message_expiries (message_id, user_id, expires_at)
+		SELECT m.id, $2, NOW() + m.disappear_after * INTERVAL '1 second'
+		FROM messages m
+		WHERE m.id = ANY($1::uuid[]) AND m.disappear_mode = 'read' AND m.sender_id != $2
+		ON CONFLICT (message_id, user_id) DO UPDATE SET expires_at = message_expiries.expires_at
+		RETURNING message_id, expires_at
+	`, pq.Array(uuidStrings(messageIDs)), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &expiresAt); err != nil {
+			return nil, err
+		}
+		expiries[id] = expiresAt
+	}
+
+	return expiries, rows.Err()
+}
+
+// StartDisappearingReaper periodically removes disappearing messages whose
+// timers have run out and tells the affected clients. DISAPPEAR_REAP_INTERVAL
+// and DISAPPEAR_BATCH_SIZE tune how often it runs and how many rows each
+// transaction handles. Row locks are taken with SKIP LOCKED, so several
+// instances can run the reaper at once.
+func StartDisappearingReaper() {
+	interval := envDuration("DISAPPEAR_REAP_INTERVAL", 15*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reapDisappearingMessages(envInt("DISAPPEAR_BATCH_SIZE", 500))
+		<-ticker.C
+	}
+}
+
+func reapDisappearingMessages(batchSize int) {
+	started := time.Now()
+	disappearingMetrics.Add("runs", 1)
+
+	// Per-recipient notices go out first; deleting a message cascades to its
+	// timers.
+	for {
+		n, err := notifyExpiredForRecipients(batchSize)
+		if err != nil {
+			log.Printf("Error notifying expired messages: %v", err)
+			disappearingMetrics.Add("errors", 1)
+			break
+		}
+		if n < batchSize {
+			break
+		}
+	}
+
+	// Sent-mode messages are gone once their own expiry passes; read-mode
+	// messages once every other member's timer has run out.
+	candidates := []string{
+		`SELECT id FROM messages
+		WHERE expires_at <= NOW()
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`,
+		`SELECT m.id FROM messages m
+		WHERE m.disappear_mode = 'read'
+		  AND m.id IN (SELECT message_id FROM message_expiries WHERE expires_at <= NOW())
+		  AND NOT EXISTS (
+			SELECT 1 FROM chat_members cm
+			WHERE cm.chat_id = m.chat_id AND cm.user_id != m.sender_id
+			  AND NOT EXISTS (
+				SELECT 1 FROM message_expiries e
+				WHERE e.message_id = m.id AND e.user_id = cm.user_id AND e.expires_at <= NOW()
+			  )
+		  )
+		LIMIT $1
+		FOR UPDATE OF m SKIP LOCKED`,
+	}
+
+	for _, candidate := range candidates {
+		for {
+			n, err := deleteExpiredBatch(candidate, batchSize)
+			if err != nil {
+				log.Printf("Error deleting expired messages: %v", err)
+				disappearingMetrics.Add("errors", 1)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+	}
+
+	disappearingMetrics.Set("lastRunUnix", expvarInt(started.Unix()))
+	disappearingMetrics.Set("lastRunMillis", expvarInt(time.Since(started).Milliseconds()))
+}
+
+// notifyExpiredForRecipients tells each recipient whose read-mode timer has
+// run out to drop the message locally, marking the timer as notified.
+func notifyExpiredForRecipients(batchSize int) (int, error) {
+	rows, err := db.DB().Query(`
+		UPDATE message_expiries e
+		SET notified = TRUE
+		FROM messages m
+		WHERE m.id = e.message_id
+		  AND (e.message_id, e.user_id) IN (
+			SELECT message_id, user_id FROM message_expiries
+			WHERE NOT notified AND expires_at <= NOW()
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		  )
+		RETURNING e.user_id, m.chat_id, e.message_id
+	`, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type key struct {
+		userID uuid.UUID
+		chatID uuid.UUID
+	}
+	expired := map[key][]string{}
+	count := 0
+	for rows.Next() {
+		var k key
+		var messageID uuid.UUID
+		if err := rows.Scan(&k.userID, &k.chatID, &messageID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired[k] = append(expired[k], messageID.String())
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for k, ids := range expired {
+		SendToUser(k.userID.String(), WSMessage{
+			Type: DeleteMessageType,
+			Payload: map[string]interface{}{
+				"chatId":     k.chatID.String(),
+				"messageIds": ids,
+				"reason":     "expired",
+			},
+		})
+	}
+
+	disappearingMetrics.Add("recipientsNotified", int64(count))
+	return count, nil
+}
+
+// deleteExpiredBatch deletes up to batchSize messages picked by candidate,
+// repairs the last-message fields of every chat it touched in the same
+// transaction and then broadcasts the deletions.
+func deleteExpiredBatch(candidate string, batchSize int) (int, error) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM messages
+		WHERE id IN (`+candidate+`)
+		RETURNING id, chat_id
+	`, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := map[uuid.UUID][]string{}
+	count := 0
+	for rows.Next() {
+		var id, chatID uuid.UUID
+		if err := rows.Scan(&id, &chatID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deleted[chatID] = append(deleted[chatID], id.String())
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	for chatID := range deleted {
+		if err := refreshChatLastMessage(tx, chatID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	disappearingMetrics.Add("messagesDeleted", int64(count))
+
+	for chatID, ids := range deleted {
+		SendToChat(chatID, WSMessage{
+			Type: DeleteMessageType,
+			Payload: map[string]interface{}{
+				"chatId":     chatID.String(),
+				"messageIds": ids,
+				"reason":     "expired",
+			},
+		}, "")
+	}
+
+	return count, nil
+}
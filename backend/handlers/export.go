@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// exportBatchSize is how many messages are read from the snapshot at a time,
+// so an export never holds more than one batch in memory.
+const exportBatchSize = 500
+
+const exportTimeLayout = "2006-01-02 15:04:05"
+
+type exportMessage struct {
+	ID          uuid.UUID          `json:"id"`
+	SenderID    uuid.UUID          `json:"senderId"`
+	SenderName  string             `json:"senderName"`
+	Content     string             `json:"content"`
+	IsSystem    bool               `json:"isSystem,omitempty"`
+	SentAt      time.Time          `json:"sentAt"`
+	EditedAt    *time.Time         `json:"editedAt,omitempty"`
+	Edits       []exportEdit       `json:"edits,omitempty"`
+	Attachments []exportAttachment `json:"attachments,omitempty"`
+}
+
+// exportEdit is an earlier version of a message, replaced at EditedAt.
+type exportEdit struct {
+	Content  string    `json:"content"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// exportAttachment refers to an attachment by its download URL; the file
+// itself is not part of the export.
+type exportAttachment struct {
+	ID          uuid.UUID `json:"id"`
+	FileName    string    `json:"fileName"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	URL         string    `json:"url"`
+}
+
+type chatExporter interface {
+	contentType() string
+	extension() string
+	begin(chat models.Chat, exportedAt time.Time) error
+	write(message exportMessage) error
+	end() error
+}
+
+func newChatExporter(format string, w io.Writer) chatExporter {
+	switch format {
+	case "json":
+		return &jsonExporter{w: w}
+	case "html":
+		return &htmlExporter{w: w}
+	case "txt":
+		return &textExporter{w: w}
+	default:
+		return nil
+	}
+}
+
+func ExportChatHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	buffered := bufio.NewWriterSize(c.Writer, 32<<10)
+	exporter := newChatExporter(c.DefaultQuery("format", "json"), buffered)
+	if exporter == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, html or txt"})
+		return
+	}
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	// A repeatable-read transaction gives every batch the same snapshot, so
+	// messages sent or deleted mid-export do not tear the output.
+	tx, err := db.DB().BeginTx(c.Request.Context(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		log.Printf("Error starting export transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	chat, err := getChatByID(tx, chatUUID, false)
+	if err != nil {
+		log.Printf("Error getting chat for export: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if chat.IsSecure {
+		if c.Query("confirmSecureExport") != "true" {
+			c.JSON(http.StatusPreconditionRequired, gin.H{
+				"error": "This is a secure chat. Repeat the request with confirmSecureExport=true to export it; other members will be notified",
+			})
+			return
+		}
+
+		if err := notifySecureExport(chatUUID, userUUID); err != nil {
+			log.Printf("Error notifying members of export: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to notify members of export"})
+			return
+		}
+	}
+
+	exportedAt := time.Now()
+	c.Header("Content-Type", exporter.contentType())
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s-%s%s"`,
+		chatUUID, exportedAt.UTC().Format("20060102-150405"), exporter.extension()))
+	c.Status(http.StatusOK)
+
+	if err := streamChatExport(c.Request.Context(), tx, exporter, chat, userUUID, clearedAt, exportedAt, buffered, c.Writer); err != nil {
+		// Headers are already sent, so the client sees a truncated file.
+		log.Printf("Error streaming chat export %s: %v", chatUUID, err)
+		return
+	}
+
+	buffered.Flush()
+}
+
+func streamChatExport(ctx context.Context, tx *sql.Tx, exporter chatExporter, chat models.Chat, viewerID uuid.UUID,
+	clearedAt sql.NullTime, exportedAt time.Time, buffered *bufio.Writer, flusher http.Flusher) error {
+
+	if err := exporter.begin(chat, exportedAt); err != nil {
+		return err
+	}
+
+	var afterAt time.Time
+	var afterID uuid.UUID
+	first := true
+
+	for {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT m.id, m.sender_id, COALESCE(u.display_name, ''), m.content, m.is_system, m.sent_at, m.edited_at
+			FROM messages m
+			LEFT JOIN users u ON u.id = m.sender_id
+			WHERE `+messageVisibility+` AND m.deleted_at IS NULL
+			  AND ($4 OR (m.sent_at, m.id) > ($5, $6))
+			ORDER BY m.sent_at, m.id
+			LIMIT $7
+		`, chat.ID, clearedAt, viewerID, first, afterAt, afterID, exportBatchSize)
+		if err != nil {
+			return err
+		}
+
+		batch := []exportMessage{}
+		index := map[uuid.UUID]int{}
+		for rows.Next() {
+			var message exportMessage
+			var editedAt sql.NullTime
+			err := rows.Scan(&message.ID, &message.SenderID, &message.SenderName,
+				&message.Content, &message.IsSystem, &message.SentAt, &editedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if editedAt.Valid {
+				message.EditedAt = &editedAt.Time
+			}
+
+			index[message.ID] = len(batch)
+			batch = append(batch, message)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if err := fillExportDetails(ctx, tx, batch, index); err != nil {
+			return err
+		}
+
+		for _, message := range batch {
+			if err := exporter.write(message); err != nil {
+				return err
+			}
+			afterAt, afterID = message.SentAt, message.ID
+		}
+
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		if len(batch) < exportBatchSize {
+			break
+		}
+		first = false
+	}
+
+	return exporter.end()
+}
+
+// fillExportDetails adds the edit history and attachment references to a
+// batch of exported messages. index maps message IDs to their place in the
+// batch.
+func fillExportDetails(ctx context.Context, tx *sql.Tx, batch []exportMessage, index map[uuid.UUID]int) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(batch))
+	for i, message := range batch {
+		ids[i] = message.ID
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT message_id, content, edited_at
+		FROM message_edits
+		WHERE message_id = ANY($1::uuid[])
+		ORDER BY edited_at, id
+	`, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var messageID uuid.UUID
+		var edit exportEdit
+		if err := rows.Scan(&messageID, &edit.Content, &edit.EditedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		message := &batch[index[messageID]]
+		message.Edits = append(message.Edits, edit)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, chat_id, message_id, file_name, content_type, size_bytes
+		FROM attachments
+		WHERE message_id = ANY($1::uuid[])
+		ORDER BY created_at, id
+	`, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID, messageID uuid.UUID
+		var attachment exportAttachment
+		err := rows.Scan(&attachment.ID, &chatID, &messageID, &attachment.FileName,
+			&attachment.ContentType, &attachment.Size)
+		if err != nil {
+			return err
+		}
+		attachment.URL = attachmentURL(chatID, attachment.ID)
+
+		message := &batch[index[messageID]]
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	return rows.Err()
+}
+
+// notifySecureExport tells the other members of a secure chat that someone
+// has taken a copy of its history.
+func notifySecureExport(chatID, userID uuid.UUID) error {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	if err := tx.QueryRow(`SELECT display_name FROM users WHERE id = $1`, userID).Scan(&name); err != nil {
+		return err
+	}
+
+	message, err := insertSystemMessage(tx, chatID, userID, fmt.Sprintf("%s exported the chat history", name))
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	go SendToChat(chatID, WSMessage{
+		Type: NewMessageType,
+		Payload: map[string]interface{}{
+			"message": message,
+			"chatId":  chatID.String(),
+		},
+	}, "")
+
+	return nil
+}
+
+type jsonExporter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExporter) contentType() string { return "application/json; charset=utf-8" }
+func (e *jsonExporter) extension() string   { return ".json" }
+
+func (e *jsonExporter) begin(chat models.Chat, exportedAt time.Time) error {
+	header, err := json.Marshal(map[string]interface{}{
+		"id":       chat.ID,
+		"name":     chat.Name,
+		"isSecure": chat.IsSecure,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, `{"chat":%s,"exportedAt":%q,"messages":[`, header, exportedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (e *jsonExporter) write(message exportMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExporter) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+type htmlExporter struct {
+	w io.Writer
+}
+
+func (e *htmlExporter) contentType() string { return "text/html; charset=utf-8" }
+func (e *htmlExporter) extension() string   { return ".html" }
+
+func (e *htmlExporter) begin(chat models.Chat, exportedAt time.Time) error {
+	name := html.EscapeString(chat.Name)
+	_, err := fmt.Fprintf(e.w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>%s</title>
+<style>body{font-family:sans-serif;max-width:48em;margin:auto}.m{margin:.5em 0}.t{color:#888;font-size:.8em}.s{font-style:italic;color:#666}.a,.e{margin-left:1.5em}.e{color:#666}</style>
+</head><body>
+<h1>%s</h1>
+<p class="t">Exported %s</p>
+`, name, name, exportedAt.UTC().Format(time.RFC1123))
+	return err
+}
+
+func (e *htmlExporter) write(message exportMessage) error {
+	class := "m"
+	if message.IsSystem {
+		class = "m s"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<div class=%q><span class=\"t\">%s</span> <b>%s</b>: %s",
+		class, message.SentAt.UTC().Format(exportTimeLayout), html.EscapeString(message.SenderName),
+		htmlContent(message.Content))
+
+	if message.EditedAt != nil {
+		fmt.Fprintf(&b, " <span class=\"t\">(edited %s)</span>", message.EditedAt.UTC().Format(exportTimeLayout))
+	}
+
+	for _, attachment := range message.Attachments {
+		fmt.Fprintf(&b, "<div class=\"a\"><a href=\"%s\">%s</a> <span class=\"t\">%s, %d bytes</span></div>",
+			html.EscapeString(attachment.URL), html.EscapeString(attachment.FileName),
+			html.EscapeString(attachment.ContentType), attachment.Size)
+	}
+
+	if len(message.Edits) > 0 {
+		fmt.Fprintf(&b, "<details><summary class=\"t\">%d earlier version(s)</summary>", len(message.Edits))
+		for _, edit := range message.Edits {
+			fmt.Fprintf(&b, "<div class=\"e\"><span class=\"t\">until %s</span> %s</div>",
+				edit.EditedAt.UTC().Format(exportTimeLayout), htmlContent(edit.Content))
+		}
+		b.WriteString("</details>")
+	}
+
+	b.WriteString("</div>\n")
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func htmlContent(content string) string {
+	return strings.ReplaceAll(html.EscapeString(content), "\n", "<br>")
+}
+
+func (e *htmlExporter) end() error {
+	_, err := io.WriteString(e.w, "</body></html>\n")
+	return err
+}
+
+type textExporter struct {
+	w io.Writer
+}
+
+func (e *textExporter) contentType() string { return "text/plain; charset=utf-8" }
+func (e *textExporter) extension() string   { return ".txt" }
+
+func (e *textExporter) begin(chat models.Chat, exportedAt time.Time) error {
+	_, err := fmt.Fprintf(e.w, "%s\nExported %s\n\n", chat.Name, exportedAt.UTC().Format(time.RFC1123))
+	return err
+}
+
+func (e *textExporter) write(message exportMessage) error {
+	sender := message.SenderName
+	if message.IsSystem {
+		sender = "*"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s: %s", message.SentAt.UTC().Format(exportTimeLayout), sender, message.Content)
+	if message.EditedAt != nil {
+		fmt.Fprintf(&b, " (edited %s)", message.EditedAt.UTC().Format(exportTimeLayout))
+	}
+	b.WriteString("\n")
+
+	for _, attachment := range message.Attachments {
+		fmt.Fprintf(&b, "    Attachment: %s (%s, %d bytes) %s\n",
+			attachment.FileName, attachment.ContentType, attachment.Size, attachment.URL)
+	}
+	for _, edit := range message.Edits {
+		fmt.Fprintf(&b, "    Earlier version, until %s: %s\n", edit.EditedAt.UTC().Format(exportTimeLayout), edit.Content)
+	}
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *textExporter) end() error {
+	return nil
+}
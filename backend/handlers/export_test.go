@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"qrconnect-backend/models"
+
+	"github.com/google/uuid"
+)
+
+func TestExportersIncludeEditsAndAttachments(t *testing.T) {
+	sentAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	editedAt := sentAt.Add(time.Hour)
+	chatID, attachmentID := uuid.New(), uuid.New()
+
+	message := exportMessage{
+		ID:         uuid.New(),
+		SenderID:   uuid.New(),
+		SenderName: "Ada",
+		Content:    "final <text>",
+		SentAt:     sentAt,
+		EditedAt:   &editedAt,
+		Edits:      []exportEdit{{Content: "first draft", EditedAt: editedAt}},
+		Attachments: []exportAttachment{{
+			ID:          attachmentID,
+			FileName:    "report.pdf",
+			ContentType: "application/pdf",
+			Size:        2048,
+			URL:         attachmentURL(chatID, attachmentID),
+		}},
+	}
+	chat := models.Chat{ID: chatID, Name: "Team"}
+
+	for _, format := range []string{"json", "html", "txt"} {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			exporter := newChatExporter(format, &out)
+			if err := exporter.begin(chat, editedAt); err != nil {
+				t.Fatal(err)
+			}
+			if err := exporter.write(message); err != nil {
+				t.Fatal(err)
+			}
+			if err := exporter.end(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.String()
+			for _, want := range []string{"first draft", "report.pdf", "application/pdf", "2048", message.Attachments[0].URL, "2024-03-01"} {
+				if !strings.Contains(got, want) {
+					t.Errorf("export is missing %q:\n%s", want, got)
+				}
+			}
+
+			if format == "json" {
+				var doc struct {
+					Messages []exportMessage `json:"messages"`
+				}
+				if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+					t.Fatalf("invalid JSON: %v", err)
+				}
+				if len(doc.Messages) != 1 || doc.Messages[0].EditedAt == nil || len(doc.Messages[0].Edits) != 1 {
+					t.Errorf("messages = %+v, want one edited message with its history", doc.Messages)
+				}
+			}
+
+			if format == "html" && strings.Contains(got, "<text>") {
+				t.Error("HTML export did not escape message content")
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxForwardTargets = 20
+
+// forwardTarget is a chat a message is being forwarded into, with the
+// settings that decide how the copy is stored.
+type forwardTarget struct {
+	chatID                uuid.UUID
+	role                  string
+	chatType              string
+	slowModeSeconds       int
+	isSecure              bool
+	defaultDisappearAfter sql.NullInt32
+}
+
+// ForwardMessageHandler copies a message into one or more chats the caller
+// belongs to. The copies point back at the original unless it came from a
+// secure chat, where only the forwarded flag is kept. Attachments are shared
+// with the original rather than uploaded again. Either every copy is stored
+// or none is.
+func ForwardMessageHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageUUID, err := uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var req struct {
+		ChatIDs []string `json:"chatIds" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.ChatIDs) == 0 || len(req.ChatIDs) > maxForwardTargets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chatIds must list between 1 and %d chats", maxForwardTargets)})
+		return
+	}
+
+	targetIDs := make([]uuid.UUID, 0, len(req.ChatIDs))
+	seen := map[uuid.UUID]bool{}
+	for _, raw := range req.ChatIDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			targetIDs = append(targetIDs, id)
+		}
+	}
+
+	var clearedAt sql.NullTime
+	var sourceSecure bool
+	err = db.DB().QueryRow(`
+		SELECT cm.cleared_at, c.is_secure
+		FROM chat_members cm
+		JOIN chats c ON c.id = cm.chat_id
+		WHERE cm.chat_id = $1 AND cm.user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt, &sourceSecure)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	source, err := scanMessage(db.DB().QueryRow(`
+		SELECT `+messageColumns+` FROM messages m
+		WHERE `+messageVisibility+` AND m.id = $4 AND m.deleted_at IS NULL
+	`, chatUUID, clearedAt, userUUID, messageUUID))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting message to forward: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if source.IsSystem {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "System messages cannot be forwarded"})
+		return
+	}
+
+	// A forwarded copy would outlive the original's timer.
+	if source.IsDisappearing {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Disappearing messages cannot be forwarded"})
+		return
+	}
+
+	targets := make([]forwardTarget, 0, len(targetIDs))
+	for _, id := range targetIDs {
+		target := forwardTarget{chatID: id}
+		err := db.DB().QueryRow(`
+			SELECT cm.role, c.chat_type, c.slow_mode_seconds, c.is_secure, c.default_disappear_after
+			FROM chat_members cm
+			JOIN chats c ON c.id = cm.chat_id
+			WHERE cm.chat_id = $1 AND cm.user_id = $2
+		`, id, userUUID).Scan(&target.role, &target.chatType, &target.slowModeSeconds,
+			&target.isSecure, &target.defaultDisappearAfter)
+
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to chat " + id.String()})
+			return
+		}
+
+		if target.chatType == ChatTypeAnnouncement && !isAdminRole(target.role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can post in announcement channels"})
+			return
+		}
+
+		// Ciphertext is meaningless in a plain chat and plaintext must not
+		// land in a secure one.
+		if source.Content != "" && target.isSecure != sourceSecure {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Messages can only be forwarded between chats of the same security level"})
+			return
+		}
+
+		targets = append(targets, target)
+	}
+
+	if ok, wait := allowMessage(userUUID.String()); !ok {
+		respondTooManyRequests(c, "You are sending messages too quickly", wait)
+		return
+	}
+
+	var forwardedFromID uuid.NullUUID
+	if !sourceSecure {
+		forwardedFromID = uuid.NullUUID{UUID: source.ID, Valid: true}
+	}
+
+	preview := source.Content
+	if preview == "" {
+		preview = attachmentPreview
+	}
+
+	now := time.Now()
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	messages := make([]models.Message, 0, len(targets))
+	for _, target := range targets {
+		if target.slowModeSeconds > 0 && !isAdminRole(target.role) {
+			interval := time.Duration(target.slowModeSeconds) * time.Second
+			wait, err := slowModeWait(tx, target.chatID, userUUID, interval, now)
+			if err != nil {
+				log.Printf("Error checking slow mode: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			if wait > 0 {
+				respondTooManyRequests(c, "Slow mode is enabled in chat "+target.chatID.String(), wait)
+				return
+			}
+		}
+
+		message := models.Message{
+			ID:          uuid.New(),
+			ChatID:      target.chatID,
+			SenderID:    userUUID,
+			Kind:        source.Kind,
+			Content:     source.Content,
+			Payload:     source.Payload,
+			Status:      ReceiptSent,
+			SentAt:      now,
+			IsForwarded: true,
+		}
+		if forwardedFromID.Valid {
+			message.ForwardedFromID = &forwardedFromID.UUID
+		}
+
+		// The target chat's own timer applies to the copy.
+		var expiresAt sql.NullTime
+		if chatTimer := effectiveDisappearAfter(target.isSecure, target.defaultDisappearAfter); chatTimer > 0 {
+			message.IsDisappearing = true
+			message.DisappearAfter = chatTimer
+			message.DisappearFrom = DisappearFromSent
+			expiresAt = sql.NullTime{Time: now.Add(time.Duration(chatTimer) * time.Second), Valid: true}
+			message.ExpiresAt = &expiresAt.Time
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO messages (id, chat_id, sender_id, content, is_read, is_disappearing, disappear_after,
+				disappear_mode, expires_at, is_forwarded, forwarded_from_id, sent_at, kind, payload)
+			VALUES ($1, $2, $3, $4, false, $5, $6, NULLIF($7, ''), $8, true, $9, $10, $11, $12)
+		`, message.ID, message.ChatID, userUUID, message.Content, message.IsDisappearing, message.DisappearAfter,
+			message.DisappearFrom, expiresAt, forwardedFromID, now, message.Kind, payloadValue(message.Payload))
+
+		if err != nil {
+			log.Printf("Error storing forwarded message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forward message"})
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO attachments (id, chat_id, message_id, uploader_id, storage_key, file_name,
+				content_type, size_bytes, linked_at)
+			SELECT gen_random_uuid(), $1, $2, $3, storage_key, file_name, content_type, size_bytes, NOW()
+			FROM attachments
+			WHERE message_id = $4
+		`, message.ChatID, message.ID, userUUID, source.ID)
+
+		if err != nil {
+			log.Printf("Error copying attachments: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forward message"})
+			return
+		}
+
+		if err := setChatLastMessage(tx, message.ChatID, preview, now); err != nil {
+			log.Printf("Error updating chat last message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+			return
+		}
+
+		messages = append(messages, message)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	if err := fillAttachments(db.DB(), messages); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	var sender models.User
+	err = db.DB().QueryRow(`
+		SELECT id, username, display_name, profile_picture, created_at, updated_at
+		FROM users
+		WHERE id = $1
+	`, userUUID).Scan(&sender.ID, &sender.Username, &sender.DisplayName, &sender.ProfilePicture,
+		&sender.CreatedAt, &sender.UpdatedAt)
+
+	if err != nil {
+		log.Printf("Error getting sender details: %v", err)
+	}
+
+	go func() {
+		for _, message := range messages {
+			delivered := SendToChat(message.ChatID, WSMessage{
+				Type: NewMessageType,
+				Payload: map[string]interface{}{
+					"message": message,
+					"sender":  sender,
+					"chatId":  message.ChatID.String(),
+				},
+			}, userUUID.String())
+			markDelivered(message.ChatID, message.ID, delivered)
+		}
+	}()
+
+	c.JSON(http.StatusCreated, gin.H{"messages": messages})
+}
@@ -0,0 +1,752 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestApproved = "approved"
+	JoinRequestRejected = "rejected"
+)
+
+var (
+	errChatFull      = errors.New("chat is full")
+	errAlreadyMember = errors.New("user is already a member")
+)
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func inviteURL(token string) string {
+	return "/join/" + token
+}
+
+const inviteColumns = `id, chat_id, token, created_by, expires_at, max_uses, use_count,
+	requires_approval, revoked_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvite(row rowScanner) (models.ChatInvite, error) {
+	var invite models.ChatInvite
+	var createdBy uuid.NullUUID
+	var expiresAt, revokedAt sql.NullTime
+	var maxUses sql.NullInt32
+
+	err := row.Scan(
+		&invite.ID, &invite.ChatID, &invite.Token, &createdBy, &expiresAt, &maxUses,
+		&invite.UseCount, &invite.RequiresApproval, &revokedAt, &invite.CreatedAt,
+	)
+	if err != nil {
+		return invite, err
+	}
+
+	invite.URL = inviteURL(invite.Token)
+	if createdBy.Valid {
+		invite.CreatedBy = createdBy.UUID
+	}
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.Time
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int32)
+		invite.MaxUses = &n
+	}
+	if revokedAt.Valid {
+		invite.RevokedAt = &revokedAt.Time
+	}
+
+	return invite, nil
+}
+
+// inviteProblem explains why an invite can no longer be used, or returns ""
+// when it is still valid.
+func inviteProblem(invite models.ChatInvite) string {
+	switch {
+	case invite.RevokedAt != nil:
+		return "This invite link has been revoked"
+	case invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt):
+		return "This invite link has expired"
+	case invite.MaxUses != nil && invite.UseCount >= *invite.MaxUses:
+		return "This invite link has reached its maximum number of uses"
+	default:
+		return ""
+	}
+}
+
+func CreateInviteHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can manage invite links"})
+		return
+	}
+
+	var req struct {
+		ExpiresIn        *int `json:"expiresIn"`
+		MaxUses          *int `json:"maxUses"`
+		RequiresApproval bool `json:"requiresApproval"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.ExpiresIn != nil && *req.ExpiresIn <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresIn must be a positive number of seconds"})
+		return
+	}
+
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxUses must be positive"})
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		log.Printf("Error generating invite token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite link"})
+		return
+	}
+
+	var expiresAt sql.NullTime
+	if req.ExpiresIn != nil {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second), Valid: true}
+	}
+
+	invite, err := scanInvite(db.DB().QueryRow(`
+		INSERT INTO chat_invites (id, chat_id, token, created_by, expires_at, max_uses, requires_approval)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+inviteColumns,
+		uuid.New(), chatUUID, token, userUUID, expiresAt, req.MaxUses, req.RequiresApproval))
+
+	if err != nil {
+		log.Printf("Error creating invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+func GetInvitesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can manage invite links"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT `+inviteColumns+`
+		FROM chat_invites
+		WHERE chat_id = $1
+		ORDER BY created_at DESC
+	`, chatUUID)
+
+	if err != nil {
+		log.Printf("Error getting invites: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []models.ChatInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			log.Printf("Error scanning invite row: %v", err)
+			continue
+		}
+		invites = append(invites, invite)
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+func RevokeInviteHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	inviteUUID, err := uuid.Parse(c.Param("inviteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can manage invite links"})
+		return
+	}
+
+	result, err := db.DB().Exec(`
+		UPDATE chat_invites
+		SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1 AND chat_id = $2
+	`, inviteUUID, chatUUID)
+
+	if err != nil {
+		log.Printf("Error revoking invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite link"})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func PreviewInviteHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	invite, err := scanInvite(db.DB().QueryRow(`
+		SELECT `+inviteColumns+` FROM chat_invites WHERE token = $1
+	`, c.Param("token")))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if problem := inviteProblem(invite); problem != "" {
+		c.JSON(http.StatusGone, gin.H{"error": problem})
+		return
+	}
+
+	var name, chatType, description string
+	var memberCount int
+	var alreadyMember, pending bool
+
+	err = db.DB().QueryRow(`
+		SELECT c.name, c.chat_type, COALESCE(c.description, ''),
+			   (SELECT COUNT(*) FROM chat_members WHERE chat_id = c.id),
+			   EXISTS (SELECT 1 FROM chat_members WHERE chat_id = c.id AND user_id = $2),
+			   EXISTS (SELECT 1 FROM chat_join_requests
+					   WHERE chat_id = c.id AND user_id = $2 AND status = 'pending')
+		FROM chats c
+		WHERE c.id = $1
+	`, invite.ChatID, userUUID).Scan(&name, &chatType, &description, &memberCount, &alreadyMember, &pending)
+
+	if err != nil {
+		log.Printf("Error getting invite chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"chatId":           invite.ChatID,
+		"name":             name,
+		"type":             chatType,
+		"description":      description,
+		"memberCount":      memberCount,
+		"requiresApproval": invite.RequiresApproval,
+		"expiresAt":        invite.ExpiresAt,
+		"alreadyMember":    alreadyMember,
+		"pendingRequest":   pending,
+	})
+}
+
+func JoinViaInviteHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	invite, err := scanInvite(tx.QueryRow(`
+		SELECT `+inviteColumns+` FROM chat_invites WHERE token = $1 FOR UPDATE
+	`, c.Param("token")))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if problem := inviteProblem(invite); problem != "" {
+		c.JSON(http.StatusGone, gin.H{"error": problem})
+		return
+	}
+
+	if _, err := getMemberRole(tx, invite.ChatID, userUUID); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already a member of this chat", "chatId": invite.ChatID})
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Error checking chat membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// As when a chat is created, nobody joins a chat with someone they have
+	// a block with.
+	blocked, err := hasBlockInChat(tx, invite.ChatID, userUUID)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot join this chat"})
+		return
+	}
+
+	if invite.RequiresApproval {
+		var requestID uuid.UUID
+		err = tx.QueryRow(`
+			SELECT id FROM chat_join_requests
+			WHERE chat_id = $1 AND user_id = $2 AND status = 'pending'
+		`, invite.ChatID, userUUID).Scan(&requestID)
+
+		if err == nil {
+			c.JSON(http.StatusAccepted, gin.H{"status": JoinRequestPending, "requestId": requestID, "chatId": invite.ChatID})
+			return
+		} else if err != sql.ErrNoRows {
+			log.Printf("Error checking join requests: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		requestID = uuid.New()
+		_, err = tx.Exec(`
+			INSERT INTO chat_join_requests (id, chat_id, user_id, invite_id)
+			VALUES ($1, $2, $3, $4)
+		`, requestID, invite.ChatID, userUUID, invite.ID)
+
+		if err != nil {
+			log.Printf("Error creating join request: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request to join"})
+			return
+		}
+
+		if err := useInvite(tx, invite.ID); err != nil {
+			log.Printf("Error updating invite use count: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request to join"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing transaction: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request to join"})
+			return
+		}
+
+		go notifyChatAdmins(invite.ChatID, WSMessage{
+			Type: JoinRequestType,
+			Payload: map[string]interface{}{
+				"chatId":    invite.ChatID.String(),
+				"requestId": requestID.String(),
+				"userId":    userUUID.String(),
+			},
+		})
+
+		c.JSON(http.StatusAccepted, gin.H{"status": JoinRequestPending, "requestId": requestID, "chatId": invite.ChatID})
+		return
+	}
+
+	message, err := addChatMember(tx, invite.ChatID, userUUID)
+	if err == errChatFull {
+		c.JSON(http.StatusConflict, gin.H{"error": "This chat is full"})
+		return
+	} else if err == errAlreadyMember {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already a member of this chat", "chatId": invite.ChatID})
+		return
+	} else if err != nil {
+		log.Printf("Error adding member via invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join chat"})
+		return
+	}
+
+	if err := useInvite(tx, invite.ID); err != nil {
+		log.Printf("Error updating invite use count: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join chat"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join chat"})
+		return
+	}
+
+	afterMemberJoined(invite.ChatID, userUUID, message)
+
+	c.JSON(http.StatusOK, gin.H{"status": "joined", "chatId": invite.ChatID})
+}
+
+func useInvite(tx *sql.Tx, inviteID uuid.UUID) error {
+	_, err := tx.Exec(`UPDATE chat_invites SET use_count = use_count + 1 WHERE id = $1`, inviteID)
+	return err
+}
+
+// hasBlockInChat reports whether userID has blocked, or is blocked by, any
+// member of chatID. It starts from the user's blocks, which are few, rather
+// than from the members, which in a channel can be many.
+func hasBlockInChat(q queryer, chatID, userID uuid.UUID) (bool, error) {
+	var blocked bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks b
+			JOIN chat_members cm ON cm.chat_id = $1
+			 AND cm.user_id = CASE WHEN b.blocker_id = $2 THEN b.blocked_id ELSE b.blocker_id END
+			WHERE b.blocker_id = $2 OR b.blocked_id = $2
+		)
+	`, chatID, userID).Scan(&blocked)
+	return blocked, err
+}
+
+// addChatMember inserts a regular member, enforcing the chat's size limit,
+// and returns the system message announcing them. Announcement channels get
+// no such message, as joins there would drown out the announcements.
+func addChatMember(tx *sql.Tx, chatID, userID uuid.UUID) (*models.Message, error) {
+	var chatType string
+	var memberCount int
+	err := tx.QueryRow(`
+		SELECT chat_type, (SELECT COUNT(*) FROM chat_members WHERE chat_id = $1)
+		FROM chats
+		WHERE id = $1
+		FOR UPDATE
+	`, chatID).Scan(&chatType, &memberCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if memberCount >= maxChatSize(chatType) {
+		return nil, errChatFull
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO chat_members (chat_id, user_id, role)
+		VALUES ($1, $2, 'member')
+		ON CONFLICT DO NOTHING
+	`, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, errAlreadyMember
+	}
+
+	if chatType == ChatTypeAnnouncement {
+		return nil, nil
+	}
+
+	var name string
+	if err := tx.QueryRow(`SELECT display_name FROM users WHERE id = $1`, userID).Scan(&name); err != nil {
+		return nil, err
+	}
+
+	message, err := insertSystemMessage(tx, chatID, userID, fmt.Sprintf("%s joined the chat", name))
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func afterMemberJoined(chatID, userID uuid.UUID, message *models.Message) {
+	invalidateChatMembers(chatID)
+
+	go func() {
+		SendToChat(chatID, WSMessage{
+			Type: MemberJoinedType,
+			Payload: map[string]interface{}{
+				"chatId": chatID.String(),
+				"userId": userID.String(),
+			},
+		}, "")
+		if message != nil {
+			SendToChat(chatID, WSMessage{
+				Type: NewMessageType,
+				Payload: map[string]interface{}{
+					"message": message,
+					"chatId":  chatID.String(),
+				},
+			}, "")
+		}
+	}()
+}
+
+func notifyChatAdmins(chatID uuid.UUID, message WSMessage) {
+	rows, err := db.DB().Query(`
+		SELECT user_id FROM chat_members
+		WHERE chat_id = $1 AND role IN ('admin', 'owner')
+	`, chatID)
+	if err != nil {
+		log.Printf("Error getting chat admins: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adminID uuid.UUID
+		if err := rows.Scan(&adminID); err != nil {
+			log.Printf("Error scanning admin row: %v", err)
+			continue
+		}
+		SendToUser(adminID.String(), message)
+	}
+}
+
+func GetJoinRequestsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can review join requests"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT r.id, r.chat_id, r.invite_id, r.status, r.created_at,
+			   u.id, u.username, u.display_name, u.profile_picture
+		FROM chat_join_requests r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.chat_id = $1 AND r.status = 'pending'
+		ORDER BY r.created_at
+	`, chatUUID)
+
+	if err != nil {
+		log.Printf("Error getting join requests: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	requests := []models.JoinRequest{}
+	for rows.Next() {
+		var request models.JoinRequest
+		var inviteID uuid.NullUUID
+		var profilePicture sql.NullString
+
+		err := rows.Scan(
+			&request.ID, &request.ChatID, &inviteID, &request.Status, &request.CreatedAt,
+			&request.User.ID, &request.User.Username, &request.User.DisplayName, &profilePicture,
+		)
+		if err != nil {
+			log.Printf("Error scanning join request row: %v", err)
+			continue
+		}
+
+		if inviteID.Valid {
+			request.InviteID = &inviteID.UUID
+		}
+		if profilePicture.Valid {
+			request.User.ProfilePicture = profilePicture.String
+		}
+
+		requests = append(requests, request)
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+func ApproveJoinRequestHandler(c *gin.Context) {
+	decideJoinRequest(c, JoinRequestApproved)
+}
+
+func RejectJoinRequestHandler(c *gin.Context) {
+	decideJoinRequest(c, JoinRequestRejected)
+}
+
+func decideJoinRequest(c *gin.Context, decision string) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	requestUUID, err := uuid.Parse(c.Param("requestId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	role, err := getMemberRole(db.DB(), chatUUID, userUUID)
+	if err != nil || !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can review join requests"})
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var requesterID uuid.UUID
+	var status string
+	err = tx.QueryRow(`
+		SELECT user_id, status FROM chat_join_requests
+		WHERE id = $1 AND chat_id = $2
+		FOR UPDATE
+	`, requestUUID, chatUUID).Scan(&requesterID, &status)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Join request not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting join request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if status != JoinRequestPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Join request was already " + status})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE chat_join_requests
+		SET status = $1, decided_by = $2, decided_at = NOW()
+		WHERE id = $3
+	`, decision, userUUID, requestUUID)
+
+	if err != nil {
+		log.Printf("Error updating join request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// A requester who got in some other way meanwhile is simply approved.
+	var message *models.Message
+	joined := false
+	if decision == JoinRequestApproved {
+		message, err = addChatMember(tx, chatUUID, requesterID)
+		joined = err == nil
+		if err == errChatFull {
+			c.JSON(http.StatusConflict, gin.H{"error": "This chat is full"})
+			return
+		} else if err != nil && err != errAlreadyMember {
+			log.Printf("Error adding approved member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if joined {
+		afterMemberJoined(chatUUID, requesterID, message)
+	}
+
+	go SendToUser(requesterID.String(), WSMessage{
+		Type: JoinRequestDecidedType,
+		Payload: map[string]interface{}{
+			"chatId":    chatUUID.String(),
+			"requestId": requestUUID.String(),
+			"status":    decision,
+		},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "status": decision})
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Message kinds. Each kind other than text and system has a JSON payload
+// whose "v" field names the schema version it follows.
+const (
+	KindText       = "text"
+	KindSystem     = "system"
+	KindAttachment = "attachment"
+	KindLocation   = "location"
+	KindContact    = "contact"
+	KindPoll       = "poll"
+)
+
+const payloadVersion = 1
+
+const (
+	maxPlaceNameLength    = 200
+	maxAddressLength      = 500
+	maxContactNameLength  = 200
+	maxContactFields      = 10
+	maxPhoneLength        = 32
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	minPollOptions        = 2
+	maxPollOptions        = 10
+)
+
+// The v1 payload of each kind.
+type attachmentPayload struct {
+	Version int `json:"v"`
+}
+
+type locationPayload struct {
+	Version   int      `json:"v"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Accuracy  *float64 `json:"accuracy,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+}
+
+type contactPayload struct {
+	Version int        `json:"v"`
+	Name    string     `json:"name"`
+	Phones  []string   `json:"phones,omitempty"`
+	Emails  []string   `json:"emails,omitempty"`
+	UserID  *uuid.UUID `json:"userId,omitempty"`
+}
+
+type pollPayload struct {
+	Version        int      `json:"v"`
+	Question       string   `json:"question"`
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multipleChoice,omitempty"`
+}
+
+var errPayloadVersion = fmt.Errorf("payload.v must be %d", payloadVersion)
+
+// decodePayload strictly decodes a payload into dest.
+func decodePayload(raw json.RawMessage, dest interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dest); err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+	return nil
+}
+
+// validateMessageKind checks a client-sent kind and payload and returns the
+// payload in its canonical form along with fallback text for clients that
+// don't understand the kind. Secure chats keep structured data inside the
+// encrypted content, so there the payload must be left out.
+func validateMessageKind(kind string, raw json.RawMessage, hasAttachments, isSecure bool) (json.RawMessage, string, error) {
+	if len(raw) > 0 && string(raw) == "null" {
+		raw = nil
+	}
+
+	switch kind {
+	case KindText:
+		if raw != nil {
+			return nil, "", errors.New("text messages take no payload")
+		}
+		return nil, "", nil
+	case KindSystem:
+		return nil, "", errors.New("system messages can only be created by the server")
+	case KindAttachment, KindLocation, KindContact, KindPoll:
+	default:
+		return nil, "", fmt.Errorf("unknown message kind %q", kind)
+	}
+
+	if kind == KindAttachment && !hasAttachments {
+		return nil, "", errors.New("attachment messages need attachments")
+	}
+
+	if isSecure {
+		if raw != nil {
+			return nil, "", errors.New("secure chats carry the payload inside the encrypted content")
+		}
+		return nil, "", nil
+	}
+
+	if raw == nil {
+		if kind == KindAttachment {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("%s messages need a payload", kind)
+	}
+
+	var payload interface{}
+	var fallback string
+	switch kind {
+	case KindAttachment:
+		var p attachmentPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, "", err
+		}
+		if p.Version != payloadVersion {
+			return nil, "", errPayloadVersion
+		}
+		payload = p
+	case KindLocation:
+		var p locationPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, "", err
+		}
+		if p.Version != payloadVersion {
+			return nil, "", errPayloadVersion
+		}
+		if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+			return nil, "", errors.New("latitude must be within ±90 and longitude within ±180")
+		}
+		if p.Accuracy != nil && *p.Accuracy < 0 {
+			return nil, "", errors.New("accuracy cannot be negative")
+		}
+		p.Name = strings.TrimSpace(p.Name)
+		p.Address = strings.TrimSpace(p.Address)
+		if len(p.Name) > maxPlaceNameLength || len(p.Address) > maxAddressLength {
+			return nil, "", fmt.Errorf("name and address cannot exceed %d and %d characters", maxPlaceNameLength, maxAddressLength)
+		}
+		payload = p
+		if p.Name != "" {
+			fallback = "Location: " + p.Name
+		} else {
+			fallback = fmt.Sprintf("Location: %.5f, %.5f", p.Latitude, p.Longitude)
+		}
+	case KindContact:
+		var p contactPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, "", err
+		}
+		if p.Version != payloadVersion {
+			return nil, "", errPayloadVersion
+		}
+		p.Name = strings.TrimSpace(p.Name)
+		if p.Name == "" || len(p.Name) > maxContactNameLength {
+			return nil, "", fmt.Errorf("contact name must be 1 to %d characters", maxContactNameLength)
+		}
+		if len(p.Phones) > maxContactFields || len(p.Emails) > maxContactFields {
+			return nil, "", fmt.Errorf("a contact can have at most %d phones and %d emails", maxContactFields, maxContactFields)
+		}
+		for _, phone := range p.Phones {
+			if strings.TrimSpace(phone) == "" || len(phone) > maxPhoneLength {
+				return nil, "", fmt.Errorf("phone numbers must be 1 to %d characters", maxPhoneLength)
+			}
+		}
+		for _, email := range p.Emails {
+			if _, err := mail.ParseAddress(email); err != nil {
+				return nil, "", fmt.Errorf("invalid email %q", email)
+			}
+		}
+		payload = p
+		fallback = "Contact: " + p.Name
+	case KindPoll:
+		var p pollPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, "", err
+		}
+		if p.Version != payloadVersion {
+			return nil, "", errPayloadVersion
+		}
+		p.Question = strings.TrimSpace(p.Question)
+		if p.Question == "" || len(p.Question) > maxPollQuestionLength {
+			return nil, "", fmt.Errorf("poll question must be 1 to %d characters", maxPollQuestionLength)
+		}
+		if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+			return nil, "", fmt.Errorf("a poll needs %d to %d options", minPollOptions, maxPollOptions)
+		}
+		seen := map[string]bool{}
+		lines := []string{"Poll: " + p.Question}
+		for i, option := range p.Options {
+			option = strings.TrimSpace(option)
+			if option == "" || len(option) > maxPollOptionLength {
+				return nil, "", fmt.Errorf("poll options must be 1 to %d characters", maxPollOptionLength)
+			}
+			if seen[option] {
+				return nil, "", errors.New("poll options must be unique")
+			}
+			seen[option] = true
+			p.Options[i] = option
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+		}
+		payload = p
+		fallback = strings.Join(lines, "\n")
+	}
+
+	canonical, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return canonical, fallback, nil
+}
+
+// payloadValue converts a payload for a JSONB parameter.
+func payloadValue(payload json.RawMessage) interface{} {
+	if len(payload) == 0 {
+		return nil
+	}
+	return string(payload)
+}
+
+// inferKind picks the kind for a send that didn't name one.
+func inferKind(content string, hasAttachments bool) string {
+	if content == "" && hasAttachments {
+		return KindAttachment
+	}
+	return KindText
+}
+
+// acceptedKinds reads the kinds a client understands from the "kinds" query
+// parameter or the X-Message-Kinds header, as a comma-separated list. It
+// returns nil when the client didn't say, meaning every kind.
+func acceptedKinds(c *gin.Context) map[string]bool {
+	list := c.Query("kinds")
+	if list == "" {
+		list = c.GetHeader("X-Message-Kinds")
+	}
+	return parseKinds(list)
+}
+
+func parseKinds(list string) map[string]bool {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+
+	kinds := map[string]bool{KindText: true}
+	for _, kind := range strings.Split(list, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			kinds[kind] = true
+		}
+	}
+	return kinds
+}
+
+// downgradeKinds turns messages of kinds the client doesn't understand into
+// text messages carrying their fallback text.
+func downgradeKinds(kinds map[string]bool, messages []models.Message) {
+	if kinds == nil {
+		return
+	}
+	for i := range messages {
+		downgradeKind(kinds, &messages[i])
+	}
+}
+
+func downgradeKind(kinds map[string]bool, message *models.Message) {
+	if kinds == nil || kinds[message.Kind] {
+		return
+	}
+	if message.Content == "" && message.DeletedAt == nil {
+		message.Content = attachmentPreview
+	}
+	message.Kind = KindText
+	message.Payload = nil
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"qrconnect-backend/models"
+)
+
+func TestValidateMessageKind(t *testing.T) {
+	tests := []struct {
+		name           string
+		kind           string
+		payload        string
+		hasAttachments bool
+		isSecure       bool
+		wantErr        bool
+		wantPayload    string
+		wantFallback   string
+	}{
+		{name: "text", kind: KindText},
+		{name: "text with null payload", kind: KindText, payload: `null`},
+		{name: "text with payload", kind: KindText, payload: `{"v":1}`, wantErr: true},
+		{name: "system", kind: KindSystem, wantErr: true},
+		{name: "unknown kind", kind: "sticker", payload: `{"v":1}`, wantErr: true},
+		{name: "empty kind", kind: "", wantErr: true},
+
+		{name: "attachment without payload", kind: KindAttachment, hasAttachments: true},
+		{name: "attachment with payload", kind: KindAttachment, payload: `{"v":1}`, hasAttachments: true,
+			wantPayload: `{"v":1}`},
+		{name: "attachment without files", kind: KindAttachment, wantErr: true},
+		{name: "attachment with wrong version", kind: KindAttachment, payload: `{"v":2}`, hasAttachments: true,
+			wantErr: true},
+
+		{name: "location with name", kind: KindLocation,
+			payload:      `{"v":1,"latitude":52.52,"longitude":13.405,"name":"  Alexanderplatz "}`,
+			wantPayload:  `{"v":1,"latitude":52.52,"longitude":13.405,"name":"Alexanderplatz"}`,
+			wantFallback: "Location: Alexanderplatz"},
+		{name: "location without name", kind: KindLocation,
+			payload:      `{"v":1,"latitude":-33.8688,"longitude":151.2093,"accuracy":12.5}`,
+			wantPayload:  `{"v":1,"latitude":-33.8688,"longitude":151.2093,"accuracy":12.5}`,
+			wantFallback: "Location: -33.86880, 151.20930"},
+		{name: "location on the boundary", kind: KindLocation, payload: `{"v":1,"latitude":90,"longitude":-180}`,
+			wantPayload: `{"v":1,"latitude":90,"longitude":-180}`, wantFallback: "Location: 90.00000, -180.00000"},
+		{name: "location latitude out of range", kind: KindLocation, payload: `{"v":1,"latitude":90.1,"longitude":0}`,
+			wantErr: true},
+		{name: "location longitude out of range", kind: KindLocation, payload: `{"v":1,"latitude":0,"longitude":-181}`,
+			wantErr: true},
+		{name: "location negative accuracy", kind: KindLocation, payload: `{"v":1,"latitude":0,"longitude":0,"accuracy":-1}`,
+			wantErr: true},
+		{name: "location name too long", kind: KindLocation,
+			payload: `{"v":1,"latitude":0,"longitude":0,"name":"` + strings.Repeat("a", maxPlaceNameLength+1) + `"}`,
+			wantErr: true},
+		{name: "location unknown field", kind: KindLocation, payload: `{"v":1,"latitude":0,"longitude":0,"altitude":3}`,
+			wantErr: true},
+		{name: "location without payload", kind: KindLocation, wantErr: true},
+		{name: "location without version", kind: KindLocation, payload: `{"latitude":0,"longitude":0}`, wantErr: true},
+		{name: "location not an object", kind: KindLocation, payload: `[1,2]`, wantErr: true},
+
+		{name: "contact", kind: KindContact,
+			payload:      `{"v":1,"name":" Ada Lovelace ","phones":["+44 20 7946 0000"],"emails":["ada@example.com"]}`,
+			wantPayload:  `{"v":1,"name":"Ada Lovelace","phones":["+44 20 7946 0000"],"emails":["ada@example.com"]}`,
+			wantFallback: "Contact: Ada Lovelace"},
+		{name: "contact with user", kind: KindContact,
+			payload:      `{"v":1,"name":"Ada","userId":"6f1c2a7e-3b9d-4c1e-8f2a-0d5b7e9c1a3f"}`,
+			wantPayload:  `{"v":1,"name":"Ada","userId":"6f1c2a7e-3b9d-4c1e-8f2a-0d5b7e9c1a3f"}`,
+			wantFallback: "Contact: Ada"},
+		{name: "contact blank name", kind: KindContact, payload: `{"v":1,"name":"   "}`, wantErr: true},
+		{name: "contact bad email", kind: KindContact, payload: `{"v":1,"name":"Ada","emails":["not an email"]}`,
+			wantErr: true},
+		{name: "contact blank phone", kind: KindContact, payload: `{"v":1,"name":"Ada","phones":[" "]}`, wantErr: true},
+		{name: "contact too many phones", kind: KindContact,
+			payload: `{"v":1,"name":"Ada","phones":["1","2","3","4","5","6","7","8","9","10","11"]}`, wantErr: true},
+		{name: "contact bad user ID", kind: KindContact, payload: `{"v":1,"name":"Ada","userId":"nope"}`, wantErr: true},
+
+		{name: "poll", kind: KindPoll,
+			payload:      `{"v":1,"question":" Lunch? ","options":[" Pizza","Sushi "],"multipleChoice":true}`,
+			wantPayload:  `{"v":1,"question":"Lunch?","options":["Pizza","Sushi"],"multipleChoice":true}`,
+			wantFallback: "Poll: Lunch?\n1. Pizza\n2. Sushi"},
+		{name: "poll with one option", kind: KindPoll, payload: `{"v":1,"question":"Lunch?","options":["Pizza"]}`,
+			wantErr: true},
+		{name: "poll with too many options", kind: KindPoll,
+			payload: `{"v":1,"question":"Pick","options":["1","2","3","4","5","6","7","8","9","10","11"]}`, wantErr: true},
+		{name: "poll with duplicate options", kind: KindPoll,
+			payload: `{"v":1,"question":"Lunch?","options":["Pizza"," Pizza "]}`, wantErr: true},
+		{name: "poll with blank option", kind: KindPoll, payload: `{"v":1,"question":"Lunch?","options":["Pizza",""]}`,
+			wantErr: true},
+		{name: "poll without question", kind: KindPoll, payload: `{"v":1,"question":"","options":["a","b"]}`,
+			wantErr: true},
+
+		{name: "secure location without payload", kind: KindLocation, isSecure: true},
+		{name: "secure location with payload", kind: KindLocation, isSecure: true,
+			payload: `{"v":1,"latitude":0,"longitude":0}`, wantErr: true},
+		{name: "secure attachment without files", kind: KindAttachment, isSecure: true, wantErr: true},
+		{name: "secure text", kind: KindText, isSecure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw json.RawMessage
+			if tt.payload != "" {
+				raw = json.RawMessage(tt.payload)
+			}
+
+			payload, fallback, err := validateMessageKind(tt.kind, raw, tt.hasAttachments, tt.isSecure)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("accepted, want an error (payload %s, fallback %q)", payload, fallback)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+
+			if string(payload) != tt.wantPayload {
+				t.Errorf("payload = %s, want %s", payload, tt.wantPayload)
+			}
+			if fallback != tt.wantFallback {
+				t.Errorf("fallback = %q, want %q", fallback, tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestDowngradeKinds(t *testing.T) {
+	messages := []models.Message{
+		{Kind: KindPoll, Content: "Poll: Lunch?\n1. Pizza\n2. Sushi", Payload: json.RawMessage(`{"v":1}`)},
+		{Kind: KindAttachment},
+		{Kind: KindLocation, Content: "Location: Home", Payload: json.RawMessage(`{"v":1}`)},
+		{Kind: KindText, Content: "hello"},
+	}
+
+	downgradeKinds(parseKinds("location, attachment"), messages)
+
+	want := []struct {
+		kind    string
+		content string
+		payload bool
+	}{
+		{KindText, "Poll: Lunch?\n1. Pizza\n2. Sushi", false},
+		{KindAttachment, "", false},
+		{KindLocation, "Location: Home", true},
+		{KindText, "hello", false},
+	}
+	for i, w := range want {
+		got := messages[i]
+		if got.Kind != w.kind || got.Content != w.content || (len(got.Payload) > 0) != w.payload {
+			t.Errorf("message %d = {%s %q %s}, want {%s %q payload: %v}",
+				i, got.Kind, got.Content, got.Payload, w.kind, w.content, w.payload)
+		}
+	}
+
+	attachment := models.Message{Kind: KindAttachment}
+	downgradeKind(parseKinds("text"), &attachment)
+	if attachment.Kind != KindText || attachment.Content != attachmentPreview {
+		t.Errorf("downgraded attachment = {%s %q}, want {%s %q}", attachment.Kind, attachment.Content, KindText, attachmentPreview)
+	}
+
+	// A client that names no kinds gets everything as stored.
+	polls := []models.Message{{Kind: KindPoll, Payload: json.RawMessage(`{"v":1}`)}}
+	downgradeKinds(parseKinds(" "), polls)
+	if polls[0].Kind != KindPoll || len(polls[0].Payload) == 0 {
+		t.Errorf("message = {%s %s}, want it left alone", polls[0].Kind, polls[0].Payload)
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"qrconnect-backend/db"
+
+	"github.com/google/uuid"
+)
+
+// memberCacheTTL bounds how stale a cached member list can get if a
+// membership change is missed by invalidateChatMembers.
+const memberCacheTTL = time.Minute
+
+type memberCacheEntry struct {
+	ids      map[string]struct{}
+	loadedAt time.Time
+}
+
+var (
+	memberCache      = make(map[uuid.UUID]memberCacheEntry)
+	memberCacheMutex = sync.RWMutex{}
+)
+
+// cachedChatMemberIDs returns the set of member IDs of a chat, loading only
+// the user_id column and keeping it in memory so fan-out does not hit the
+// database on every message.
+func cachedChatMemberIDs(chatID uuid.UUID) (map[string]struct{}, error) {
+	memberCacheMutex.RLock()
+	entry, ok := memberCache[chatID]
+	memberCacheMutex.RUnlock()
+
+	if ok && time.Since(entry.loadedAt) < memberCacheTTL {
+		return entry.ids, nil
+	}
+
+	memberIDs, err := getChatMemberIDs(db.DB(), chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]struct{}, len(memberIDs))
+	for _, id := range memberIDs {
+		ids[id] = struct{}{}
+	}
+
+	memberCacheMutex.Lock()
+	memberCache[chatID] = memberCacheEntry{ids: ids, loadedAt: time.Now()}
+	memberCacheMutex.Unlock()
+
+	return ids, nil
+}
+
+// invalidateChatMembers must be called whenever a chat's membership changes.
+func invalidateChatMembers(chatID uuid.UUID) {
+	memberCacheMutex.Lock()
+	delete(memberCache, chatID)
+	memberCacheMutex.Unlock()
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultMentionPageSize = 30
+	maxMentionPageSize     = 100
+
+	mentionAll = "all"
+)
+
+// mentionPattern finds @name tokens that start a word. Trailing dots and
+// dashes are treated as punctuation, not part of the name.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)`)
+
+// mentionMatch is one @token in message content. Offsets are in UTF-16 code
+// units, which is how the web client indexes strings.
+type mentionMatch struct {
+	name   string
+	offset int
+	length int
+}
+
+func findMentions(content string) []mentionMatch {
+	matches := []mentionMatch{}
+	for _, loc := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		name := strings.TrimRight(content[loc[2]:loc[3]], ".-")
+		if name == "" {
+			continue
+		}
+		start := loc[2] - 1 // the @
+		matches = append(matches, mentionMatch{
+			name:   name,
+			offset: utf16Len(content[:start]),
+			length: utf16Len("@" + name),
+		})
+	}
+	return matches
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// resolveMentions turns the @tokens in content, plus any user IDs the client
+// listed explicitly, into entities and the set of members to notify. Only
+// current members other than the sender can be mentioned; other tokens are
+// left as plain text, as is @all in chats larger than maxMentionAllMembers.
+// Secure chat content is ciphertext, so there only the explicit list is
+// used.
+func resolveMentions(q queryer, chatID, senderID uuid.UUID, content string, explicit []string,
+	isSecure bool) ([]models.MessageEntity, []uuid.UUID, error) {
+
+	rows, err := q.Query(`
+		SELECT u.id, u.username
+		FROM chat_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.chat_id = $1 AND cm.user_id != $2
+	`, chatID, senderID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := map[string]uuid.UUID{}
+	byID := map[uuid.UUID]bool{}
+	for rows.Next() {
+		var id uuid.UUID
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		byName[username] = id
+		byID[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	entities := []models.MessageEntity{}
+	mentioned := map[uuid.UUID]bool{}
+	all := false
+	allowAll := len(byID) < maxMentionAllMembers()
+
+	if !isSecure {
+		for _, match := range findMentions(content) {
+			if match.name == mentionAll {
+				if !allowAll {
+					continue
+				}
+				all = true
+				entities = append(entities, models.MessageEntity{
+					Type: models.EntityMentionAll, Offset: match.offset, Length: match.length,
+				})
+				continue
+			}
+			if id, ok := byName[match.name]; ok {
+				mentioned[id] = true
+				entities = append(entities, models.MessageEntity{
+					Type: models.EntityMention, Offset: match.offset, Length: match.length, UserID: &id,
+				})
+			}
+		}
+	}
+
+	for _, raw := range explicit {
+		if raw == mentionAll {
+			all = all || allowAll
+			continue
+		}
+		if id, err := uuid.Parse(raw); err == nil && byID[id] {
+			mentioned[id] = true
+		}
+	}
+
+	if all {
+		mentioned = byID
+	}
+
+	ids := make([]uuid.UUID, 0, len(mentioned))
+	for id := range mentioned {
+		ids = append(ids, id)
+	}
+	return entities, ids, nil
+}
+
+// storeMentions saves a message's mention entities and makes sure exactly
+// userIDs have a mention row, keeping the read state of rows that stay. It
+// returns the users who were not mentioned before.
+func storeMentions(tx *sql.Tx, messageID uuid.UUID, entities []models.MessageEntity, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	var entityJSON interface{}
+	if len(entities) > 0 {
+		data, err := json.Marshal(entities)
+		if err != nil {
+			return nil, err
+		}
+		entityJSON = string(data)
+	}
+
+	if _, err := tx.Exec(`UPDATE messages SET entities = $1 WHERE id = $2`, entityJSON, messageID); err != nil {
+		return nil, err
+	}
+
+	_, err := tx.Exec(`
+		DELETE FROM message_mentions
+		WHERE message_id = $1 AND NOT (user_id = ANY($2::uuid[]))
+	`, messageID, pq.Array(uuidStrings(userIDs)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`
+		INSERT INTO message_mentions (message_id, user_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	`, messageID, pq.Array(uuidStrings(userIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	added := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		added = append(added, id)
+	}
+	return added, rows.Err()
+}
+
+// notifyMentions sends a mention event to each newly mentioned user. It goes
+// out on its own, separately from new_message, so clients can alert for it
+// even in chats they have muted.
+func notifyMentions(chatID uuid.UUID, message models.Message, userIDs []uuid.UUID) {
+	for _, id := range userIDs {
+		SendToUser(id.String(), WSMessage{
+			Type: MentionType,
+			Payload: map[string]interface{}{
+				"chatId":    chatID.String(),
+				"messageId": message.ID.String(),
+				"senderId":  message.SenderID.String(),
+				"message":   message,
+			},
+		})
+	}
+}
+
+// markMentionsRead clears the unread state of the viewer's mentions among
+// the given messages.
+func markMentionsRead(q queryer, userID uuid.UUID, messageIDs []uuid.UUID) error {
+	_, err := q.Exec(`
+		UPDATE message_mentions SET read_at = NOW()
+		WHERE user_id = $1 AND message_id = ANY($2::uuid[]) AND read_at IS NULL
+	`, userID, pq.Array(uuidStrings(messageIDs)))
+	return err
+}
+
+// GetMentionsHandler lists messages that mention the caller, newest first,
+// across every chat they can still see them in. unread=true limits it to
+// mentions not yet read. The cursor for the next page is in X-Next-Cursor.
+func GetMentionsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+	limit := parseLimit(c, defaultMentionPageSize, maxMentionPageSize)
+
+	visible := `
+		FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id = mm.user_id
+		WHERE mm.user_id = $1
+		  AND m.deleted_at IS NULL
+		  AND (cm.cleared_at IS NULL OR m.sent_at > cm.cleared_at)
+		  AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		  AND NOT EXISTS (
+		      SELECT 1 FROM message_expiries e
+		      WHERE e.message_id = m.id AND e.user_id = $1 AND e.expires_at <= NOW()
+		  )
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)`
+
+	var unreadCount int
+	err := db.DB().QueryRow(`SELECT COUNT(*) `+visible+` AND mm.read_at IS NULL`, userUUID).Scan(&unreadCount)
+	if err != nil {
+		log.Printf("Error counting mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	query := `SELECT ` + messageColumns + `, mm.read_at IS NOT NULL ` + visible
+	args := []interface{}{userUUID}
+
+	if c.Query("unread") == "true" {
+		query += " AND mm.read_at IS NULL"
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		cursorAt, cursorID, err := decodeCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query += " AND (m.sent_at, m.id) < ($2, $3)"
+		args = append(args, cursorAt, cursorID)
+	}
+
+	query += fmt.Sprintf(" ORDER BY m.sent_at DESC, m.id DESC LIMIT $%d", len(args)+1)
+	args = append(args, limit+1)
+
+	rows, err := db.DB().Query(query, args...)
+	if err != nil {
+		log.Printf("Error getting mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	kinds := acceptedKinds(c)
+	mentions := []models.Mention{}
+	for rows.Next() {
+		var mention models.Mention
+		message, err := scanMessage(searchRow{rows, []interface{}{&mention.IsRead}})
+		if err != nil {
+			log.Printf("Error scanning mention: %v", err)
+			continue
+		}
+		downgradeKind(kinds, &message)
+		mention.Message = message
+		mentions = append(mentions, mention)
+	}
+
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+		last := mentions[len(mentions)-1].Message
+		c.Header(NextCursorHeader, encodeCursor(last.SentAt, last.ID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mentions":    mentions,
+		"unreadCount": unreadCount,
+	})
+}
+
+// MarkMentionsReadHandler marks the listed mentions, or all of the caller's
+// mentions when messageIds is empty, as read.
+func MarkMentionsReadHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var req struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+
+	// An empty body is the same as an empty list.
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	if len(req.MessageIDs) == 0 {
+		_, err = db.DB().Exec(`
+			UPDATE message_mentions SET read_at = NOW()
+			WHERE user_id = $1 AND read_at IS NULL
+		`, userUUID)
+	} else {
+		ids := make([]uuid.UUID, 0, len(req.MessageIDs))
+		for _, raw := range req.MessageIDs {
+			id, parseErr := uuid.Parse(raw)
+			if parseErr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+				return
+			}
+			ids = append(ids, id)
+		}
+		err = markMentionsRead(db.DB(), userUUID, ids)
+	}
+
+	if err != nil {
+		log.Printf("Error marking mentions as read: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []mentionMatch
+	}{
+		{"hi @bob", []mentionMatch{{"bob", 3, 4}}},
+		{"@bob", []mentionMatch{{"bob", 0, 4}}},
+		{"a\n@bob", []mentionMatch{{"bob", 2, 4}}},
+
+		// Trailing punctuation is not part of the name.
+		{"thanks @bob.", []mentionMatch{{"bob", 7, 4}}},
+		{"ping @bob, @carol!", []mentionMatch{{"bob", 5, 4}, {"carol", 11, 6}}},
+		{"@ann-- and @jo.doe...", []mentionMatch{{"ann", 0, 4}, {"jo.doe", 11, 7}}},
+		{"(@bob)", []mentionMatch{{"bob", 1, 4}}},
+		{"@...", []mentionMatch{}},
+
+		// Characters outside the BMP take two UTF-16 code units.
+		{"😀 @ann", []mentionMatch{{"ann", 3, 4}}},
+		{"👍🏽@ann", []mentionMatch{{"ann", 4, 4}}},
+		{"🎉🎉 @bob and 🎉 @carol", []mentionMatch{{"bob", 5, 4}, {"carol", 17, 6}}},
+		{"@𝒜bc", []mentionMatch{{"𝒜bc", 0, 5}}},
+		{"héllo @jöhn_doe", []mentionMatch{{"jöhn_doe", 6, 9}}},
+
+		// An @ inside a word is not a mention.
+		{"mail bob@example.com", []mentionMatch{}},
+		{"𝒜@bob", []mentionMatch{}},
+		{"@@bob", []mentionMatch{}},
+		{"@ann@bob", []mentionMatch{{"ann", 0, 4}}},
+
+		{"@all hands", []mentionMatch{{mentionAll, 0, 4}}},
+		{"no mentions here", []mentionMatch{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			if got := findMentions(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findMentions(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := map[string]int{
+		"":      0,
+		"abc":   3,
+		"héllo": 5,
+		"😀":     2,
+		"a😀b":   4,
+		"👍🏽":    4,
+		"𝒜":     2,
+	}
+
+	for s, want := range tests {
+		if got := utf16Len(s); got != want {
+			t.Errorf("utf16Len(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -13,6 +15,165 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+	maxClientMessageIDLen  = 64
+)
+
+// messageColumns is the column list scanned by scanMessage.
+const messageColumns = `m.id, m.chat_id, m.sender_id, m.content, m.is_read, m.is_disappearing,
+	m.disappear_after, COALESCE(m.disappear_mode, ''), m.expires_at, m.is_system, m.sent_at, m.edited_at,
+	m.deleted_at, m.deleted_by, m.reply_to_id, m.thread_root_id, m.entities,
+	m.is_forwarded, m.forwarded_from_id, m.pinned_at, m.pinned_by, COALESCE(m.client_message_id, ''),
+	m.kind, m.payload`
+
+// messageVisibility restricts a message query to what one member may see.
+// It expects $1 = chat ID, $2 = the member's cleared_at and $3 = the member's
+// user ID. Expired disappearing messages are filtered here so they are never
+// returned even when the reaper is behind, as are messages the member has
+// deleted for themselves.
+const messageVisibility = `m.chat_id = $1 AND ($2::timestamptz IS NULL OR m.sent_at > $2)
+	AND (m.expires_at IS NULL OR m.expires_at > NOW())
+	AND NOT EXISTS (
+		SELECT 1 FROM message_expiries e
+		WHERE e.message_id = m.id AND e.user_id = $3 AND e.expires_at <= NOW()
+	)
+	AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $3)`
+
+func scanMessage(row rowScanner) (models.Message, error) {
+	var message models.Message
+	var disappearAfter sql.NullInt32
+	var expiresAt, editedAt, deletedAt, pinnedAt sql.NullTime
+	var deletedBy, replyToID, threadRootID, forwardedFromID, pinnedBy uuid.NullUUID
+	var entities, payload []byte
+
+	err := row.Scan(
+		&message.ID, &message.ChatID, &message.SenderID, &message.Content,
+		&message.IsRead, &message.IsDisappearing, &disappearAfter, &message.DisappearFrom,
+		&expiresAt, &message.IsSystem, &message.SentAt, &editedAt, &deletedAt, &deletedBy,
+		&replyToID, &threadRootID, &entities, &message.IsForwarded, &forwardedFromID,
+		&pinnedAt, &pinnedBy, &message.ClientMessageID, &message.Kind, &payload,
+	)
+	if err != nil {
+		return message, err
+	}
+
+	if disappearAfter.Valid {
+		message.DisappearAfter = int(disappearAfter.Int32)
+	}
+
+	if expiresAt.Valid {
+		message.ExpiresAt = &expiresAt.Time
+	}
+
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.Time
+	}
+
+	if deletedAt.Valid {
+		message.DeletedAt = &deletedAt.Time
+	}
+
+	if deletedBy.Valid {
+		message.DeletedBy = &deletedBy.UUID
+	}
+
+	if replyToID.Valid {
+		message.ReplyToID = &replyToID.UUID
+	}
+
+	if threadRootID.Valid {
+		message.ThreadRootID = &threadRootID.UUID
+	}
+
+	if forwardedFromID.Valid {
+		message.ForwardedFromID = &forwardedFromID.UUID
+	}
+
+	if pinnedAt.Valid {
+		message.IsPinned = true
+		message.PinnedAt = &pinnedAt.Time
+	}
+
+	if pinnedBy.Valid {
+		message.PinnedBy = &pinnedBy.UUID
+	}
+
+	if len(entities) > 0 {
+		if err := json.Unmarshal(entities, &message.Entities); err != nil {
+			return message, err
+		}
+	}
+
+	if len(payload) > 0 {
+		message.Payload = payload
+	}
+
+	return message, nil
+}
+
+func getMessageByID(q queryer, messageID uuid.UUID) (models.Message, error) {
+	return scanMessage(q.QueryRow(`SELECT `+messageColumns+` FROM messages m WHERE m.id = $1`, messageID))
+}
+
+// messagePage loads up to limit visible messages on one side of an anchor,
+// walking away from it. An empty cursor condition starts from the newest
+// (desc) or oldest message. When threadRoot is set only that thread's
+// replies are loaded. Results are in the order they were walked.
+func messagePage(chatID, viewerID uuid.UUID, clearedAt sql.NullTime, threadRoot uuid.NullUUID, cursor string,
+	anchorAt time.Time, anchorID uuid.UUID, desc bool, limit int) ([]models.Message, error) {
+
+	args := []interface{}{chatID, clearedAt, viewerID}
+	query := `SELECT ` + messageColumns + ` FROM messages m WHERE ` + messageVisibility
+
+	if threadRoot.Valid {
+		args = append(args, threadRoot.UUID)
+		query += fmt.Sprintf(" AND m.thread_root_id = $%d", len(args))
+	}
+
+	if cursor != "" {
+		query += fmt.Sprintf(" AND (m.sent_at, m.id) %s ($%d, $%d)", cursor, len(args)+1, len(args)+2)
+		args = append(args, anchorAt, anchorID)
+	}
+
+	if desc {
+		query += " ORDER BY m.sent_at DESC, m.id DESC"
+	} else {
+		query += " ORDER BY m.sent_at ASC, m.id ASC"
+	}
+	query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	args = append(args, limit)
+
+	rows, err := db.DB().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("Error scanning message row: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func reverseMessages(messages []models.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+// GetMessagesHandler returns one page of a chat's history in chronological
+// order. Without a cursor it returns the newest messages; before, after and
+// around take a message ID. X-Next-Cursor carries the ID to pass as before
+// for older history and X-Prev-Cursor the ID to pass as after for newer.
 func GetMessagesHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -29,69 +190,204 @@ func GetMessagesHandler(c *gin.Context) {
 
 	userUUID, _ := uuid.Parse(userID.(string))
 
-	var count int
+	var clearedAt sql.NullTime
 	err = db.DB().QueryRow(`
-		SELECT COUNT(*) FROM chat_members
+		SELECT cleared_at FROM chat_members
 		WHERE chat_id = $1 AND user_id = $2
-	`, chatUUID, userUUID).Scan(&count)
+	`, chatUUID, userUUID).Scan(&clearedAt)
 
-	if err != nil || count == 0 {
+	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
 		return
 	}
 
-	limit := 50
-	offset := 0
+	limit := parseLimit(c, defaultMessagePageSize, maxMessagePageSize)
 
-	rows, err := db.DB().Query(`
-		SELECT id, chat_id, sender_id, content, is_read, is_disappearing, 
-			   disappear_after, sent_at
-		FROM messages
-		WHERE chat_id = $1
-		ORDER BY sent_at ASC
-		LIMIT $2 OFFSET $3
-	`, chatUUID, limit, offset)
+	mode, anchor := "", ""
+	for _, param := range []string{"before", "after", "around"} {
+		if value := c.Query(param); value != "" {
+			if mode != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Use only one of before, after or around"})
+				return
+			}
+			mode, anchor = param, value
+		}
+	}
+
+	var anchorAt time.Time
+	var anchorID uuid.UUID
+	if mode != "" {
+		anchorID, err = uuid.Parse(anchor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+			return
+		}
+
+		err = db.DB().QueryRow(`
+			SELECT sent_at FROM messages WHERE id = $1 AND chat_id = $2
+		`, anchorID, chatUUID).Scan(&anchorAt)
+
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		} else if err != nil {
+			log.Printf("Error getting cursor message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	var messages []models.Message
+	var hasOlder, hasNewer bool
+
+	switch mode {
+	case "after":
+		messages, err = messagePage(chatUUID, userUUID, clearedAt, uuid.NullUUID{}, ">", anchorAt, anchorID, false, limit+1)
+		if err == nil {
+			hasNewer = len(messages) > limit
+			if hasNewer {
+				messages = messages[:limit]
+			}
+			hasOlder = true
+		}
+
+	case "around":
+		olderLimit := limit / 2
+		var older, newer []models.Message
+		older, err = messagePage(chatUUID, userUUID, clearedAt, uuid.NullUUID{}, "<", anchorAt, anchorID, true, olderLimit+1)
+		if err == nil {
+			newer, err = messagePage(chatUUID, userUUID, clearedAt, uuid.NullUUID{}, ">=", anchorAt, anchorID, false, limit-olderLimit+1)
+		}
+		if err == nil {
+			hasOlder = len(older) > olderLimit
+			if hasOlder {
+				older = older[:olderLimit]
+			}
+			hasNewer = len(newer) > limit-olderLimit
+			if hasNewer {
+				newer = newer[:limit-olderLimit]
+			}
+			reverseMessages(older)
+			messages = append(older, newer...)
+		}
+
+	default:
+		cursor := ""
+		if mode == "before" {
+			cursor = "<"
+			hasNewer = true
+		}
+		messages, err = messagePage(chatUUID, userUUID, clearedAt, uuid.NullUUID{}, cursor, anchorAt, anchorID, true, limit+1)
+		if err == nil {
+			hasOlder = len(messages) > limit
+			if hasOlder {
+				messages = messages[:limit]
+			}
+			reverseMessages(messages)
+		}
+	}
 
 	if err != nil {
 		log.Printf("Error getting messages: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	defer rows.Close()
 
-	messages := []models.Message{}
-	for rows.Next() {
-		var message models.Message
-		var disappearAfter sql.NullInt32
+	if len(messages) > 0 {
+		if hasOlder {
+			c.Header(NextCursorHeader, messages[0].ID.String())
+		}
+		if hasNewer {
+			c.Header(PrevCursorHeader, messages[len(messages)-1].ID.String())
+		}
+	}
 
-		err := rows.Scan(
-			&message.ID, &message.ChatID, &message.SenderID, &message.Content,
-			&message.IsRead, &message.IsDisappearing, &disappearAfter, &message.SentAt,
-		)
+	markPageRead(chatUUID, userUUID, messages)
 
-		if err != nil {
-			log.Printf("Error scanning message row: %v", err)
-			continue
-		}
+	if err := fillReceiptStatus(db.DB(), userUUID, messages); err != nil {
+		log.Printf("Error getting receipt status: %v", err)
+	}
 
-		if disappearAfter.Valid {
-			message.DisappearAfter = int(disappearAfter.Int32)
-		}
+	if err := fillThreadInfo(db.DB(), userUUID, clearedAt, messages); err != nil {
+		log.Printf("Error getting thread details: %v", err)
+	}
 
-		messages = append(messages, message)
+	if err := fillReactions(db.DB(), userUUID, messages); err != nil {
+		log.Printf("Error getting reactions: %v", err)
 	}
 
-	_, err = db.DB().Exec(`
-		UPDATE messages
-		SET is_read = true
-		WHERE chat_id = $1 AND sender_id != $2 AND is_read = false
-	`, chatUUID, userUUID)
+	if err := fillAttachments(db.DB(), messages); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
 
-	if err != nil {
+	downgradeKinds(acceptedKinds(c), messages)
+
+	c.JSON(http.StatusOK, messages)
+}
+
+// markPageRead records that the viewer has read a fetched page of messages
+// and starts any read-triggered disappearing timers, filling in the
+// resulting expiry on each message.
+func markPageRead(chatID, viewerID uuid.UUID, messages []models.Message) {
+	fetched := make([]uuid.UUID, len(messages))
+	for i, message := range messages {
+		fetched[i] = message.ID
+	}
+
+	if err := markReceipts(chatID, viewerID, fetched, true); err != nil {
 		log.Printf("Error marking messages as read: %v", err)
 	}
 
-	c.JSON(http.StatusOK, messages)
+	if err := markMentionsRead(db.DB(), viewerID, fetched); err != nil {
+		log.Printf("Error marking mentions as read: %v", err)
+	}
+
+	expiries, err := startReadTimers(db.DB(), viewerID, fetched)
+	if err != nil {
+		log.Printf("Error starting disappearing timers: %v", err)
+	}
+	for i := range messages {
+		if expiresAt, ok := expiries[messages[i].ID]; ok {
+			messages[i].ExpiresAt = &expiresAt
+		}
+	}
+}
+
+// replayClientMessage answers a send whose clientMessageId was already used
+// by this sender in this chat with the stored message, or the pending
+// scheduled one, and 200. The message is filled in the same way as in the
+// original response. It reports whether it wrote a response.
+func replayClientMessage(c *gin.Context, chatID, senderID uuid.UUID, clientMessageID string) bool {
+	message, err := scanMessage(db.DB().QueryRow(`
+		SELECT `+messageColumns+` FROM messages m
+		WHERE m.chat_id = $1 AND m.sender_id = $2 AND m.client_message_id = $3
+	`, chatID, senderID, clientMessageID))
+
+	if err == sql.ErrNoRows {
+		return replayScheduledMessage(c, chatID, senderID, clientMessageID)
+	} else if err != nil {
+		log.Printf("Error checking client message ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return true
+	}
+
+	page := []models.Message{message}
+	if err := fillReceiptStatus(db.DB(), senderID, page); err != nil {
+		log.Printf("Error getting receipt status: %v", err)
+	}
+	if err := fillThreadInfo(db.DB(), senderID, sql.NullTime{}, page); err != nil {
+		log.Printf("Error getting reply details: %v", err)
+	}
+	if err := fillReactions(db.DB(), senderID, page); err != nil {
+		log.Printf("Error getting reactions: %v", err)
+	}
+	if err := fillAttachments(db.DB(), page); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+	downgradeKinds(acceptedKinds(c), page)
+
+	c.JSON(http.StatusOK, page[0])
+	return true
 }
 
 func SendMessageHandler(c *gin.Context) {
@@ -110,21 +406,39 @@ func SendMessageHandler(c *gin.Context) {
 
 	userUUID, _ := uuid.Parse(userID.(string))
 
-	var count int
+	var role, chatType string
+	var slowModeSeconds int
+	var isSecure bool
+	var defaultDisappearAfter sql.NullInt32
 	err = db.DB().QueryRow(`
-		SELECT COUNT(*) FROM chat_members
-		WHERE chat_id = $1 AND user_id = $2
-	`, chatUUID, userUUID).Scan(&count)
+		SELECT cm.role, c.chat_type, c.slow_mode_seconds, c.is_secure, c.default_disappear_after
+		FROM chat_members cm
+		JOIN chats c ON c.id = cm.chat_id
+		WHERE cm.chat_id = $1 AND cm.user_id = $2
+	`, chatUUID, userUUID).Scan(&role, &chatType, &slowModeSeconds, &isSecure, &defaultDisappearAfter)
 
-	if err != nil || count == 0 {
+	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
 		return
 	}
 
+	if chatType == ChatTypeAnnouncement && !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can post in announcement channels"})
+		return
+	}
+
 	var req struct {
-		Content        string `json:"content" binding:"required"`
-		IsDisappearing bool   `json:"isDisappearing"`
-		DisappearAfter int    `json:"disappearAfter"`
+		ClientMessageID string          `json:"clientMessageId"`
+		Content         string          `json:"content"`
+		IsDisappearing  bool            `json:"isDisappearing"`
+		DisappearAfter  int             `json:"disappearAfter"`
+		DisappearFrom   string          `json:"disappearFrom"`
+		ReplyToID       string          `json:"replyToId"`
+		AttachmentIDs   []string        `json:"attachmentIds"`
+		Mentions        []string        `json:"mentions"`
+		SendAt          *time.Time      `json:"sendAt"`
+		Kind            string          `json:"kind"`
+		Payload         json.RawMessage `json:"payload"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -132,10 +446,137 @@ func SendMessageHandler(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Attempting to store message - ChatID: %s, UserID: %s, Content: %s", chatUUID, userUUID, req.Content)
+	if len(req.ClientMessageID) > maxClientMessageIDLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("clientMessageId cannot exceed %d characters", maxClientMessageIDLen)})
+		return
+	}
+
+	// A retried send returns what the first attempt stored, without counting
+	// against the rate limit again.
+	if req.ClientMessageID != "" {
+		if replayClientMessage(c, chatUUID, userUUID, req.ClientMessageID) {
+			return
+		}
+	}
+
+	if ok, wait := allowMessage(userUUID.String()); !ok {
+		respondTooManyRequests(c, "You are sending messages too quickly", wait)
+		return
+	}
+
+	attachmentIDs, err := parseAttachmentIDs(req.AttachmentIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Kind == "" {
+		req.Kind = inferKind(req.Content, len(attachmentIDs) > 0)
+	}
+
+	payload, fallback, err := validateMessageKind(req.Kind, req.Payload, len(attachmentIDs) > 0, isSecure)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Clients that don't know the kind show the content instead, so for
+	// structured kinds it always holds the fallback, never a caption.
+	if fallback != "" {
+		req.Content = fallback
+	}
+
+	if req.Content == "" && len(attachmentIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A message needs content or attachments"})
+		return
+	}
+
+	// In secure chats an attachment-only message may carry no envelope.
+	if isSecure && req.Content != "" {
+		if err := validateCipherEnvelope(req.Content); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// A chat-level timer makes every message disappear; senders may only
+	// shorten it.
+	if chatTimer := effectiveDisappearAfter(isSecure, defaultDisappearAfter); chatTimer > 0 {
+		req.IsDisappearing = true
+		if req.DisappearAfter <= 0 || req.DisappearAfter > chatTimer {
+			req.DisappearAfter = chatTimer
+		}
+	}
+
+	var expiresAt sql.NullTime
+	if req.IsDisappearing {
+		if req.DisappearAfter <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "disappearAfter must be a positive number of seconds"})
+			return
+		}
+		if req.DisappearFrom == "" {
+			req.DisappearFrom = DisappearFromSent
+		}
+		if req.DisappearFrom != DisappearFromSent && req.DisappearFrom != DisappearFromRead {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "disappearFrom must be 'sent' or 'read'"})
+			return
+		}
+	} else {
+		req.DisappearAfter = 0
+		req.DisappearFrom = ""
+	}
+
+	var replyToID, threadRootID uuid.NullUUID
+	if req.ReplyToID != "" {
+		parentID, err := uuid.Parse(req.ReplyToID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid replyToId"})
+			return
+		}
+
+		rootID, err := resolveReplyTarget(db.DB(), chatUUID, parentID)
+		if err == errInvalidReplyTarget {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("Error checking reply target: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		replyToID = uuid.NullUUID{UUID: parentID, Valid: true}
+		threadRootID = uuid.NullUUID{UUID: rootID, Valid: true}
+	}
+
+	if req.SendAt != nil {
+		scheduled := models.ScheduledMessage{
+			ID:              uuid.New(),
+			ChatID:          chatUUID,
+			SenderID:        userUUID,
+			ClientMessageID: req.ClientMessageID,
+			Kind:            req.Kind,
+			Content:         req.Content,
+			Payload:         payload,
+			IsDisappearing:  req.IsDisappearing,
+			DisappearAfter:  req.DisappearAfter,
+			DisappearFrom:   req.DisappearFrom,
+			Mentions:        req.Mentions,
+			SendAt:          *req.SendAt,
+		}
+		if replyToID.Valid {
+			scheduled.ReplyToID = &replyToID.UUID
+		}
+		scheduleMessage(c, scheduled, attachmentIDs)
+		return
+	}
+
+	log.Printf("Attempting to store message - ChatID: %s, UserID: %s", chatUUID, userUUID)
 
 	messageID := uuid.New()
 	now := time.Now()
+	if req.DisappearFrom == DisappearFromSent {
+		expiresAt = sql.NullTime{Time: now.Add(time.Duration(req.DisappearAfter) * time.Second), Valid: true}
+	}
 
 	tx, err := db.DB().Begin()
 	if err != nil {
@@ -145,10 +586,26 @@ func SendMessageHandler(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec(`
-		INSERT INTO messages (id, chat_id, sender_id, content, is_read, is_disappearing, disappear_after, sent_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, messageID, chatUUID, userUUID, req.Content, false, req.IsDisappearing, req.DisappearAfter, now)
+	if slowModeSeconds > 0 && !isAdminRole(role) {
+		wait, err := slowModeWait(tx, chatUUID, userUUID, time.Duration(slowModeSeconds)*time.Second, now)
+		if err != nil {
+			log.Printf("Error checking slow mode: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if wait > 0 {
+			respondTooManyRequests(c, "Slow mode is enabled in this chat", wait)
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO messages (id, chat_id, sender_id, content, is_read, is_disappearing, disappear_after,
+			disappear_mode, expires_at, reply_to_id, thread_root_id, sent_at, client_message_id, kind, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12, NULLIF($13, ''), $14, $15)
+		ON CONFLICT (chat_id, sender_id, client_message_id) WHERE client_message_id IS NOT NULL DO NOTHING
+	`, messageID, chatUUID, userUUID, req.Content, false, req.IsDisappearing, req.DisappearAfter,
+		req.DisappearFrom, expiresAt, replyToID, threadRootID, now, req.ClientMessageID, req.Kind, payloadValue(payload))
 
 	if err != nil {
 		log.Printf("Error storing message in database: %v", err)
@@ -156,11 +613,39 @@ func SendMessageHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = tx.Exec(`
-		UPDATE chats
-		SET last_message = $1, last_message_at = $2
-		WHERE id = $3
-	`, req.Content, now, chatUUID)
+	// A concurrent retry got there first.
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		if !replayClientMessage(c, chatUUID, userUUID, req.ClientMessageID) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
+		}
+		return
+	}
+
+	if err := linkAttachments(tx, chatUUID, userUUID, messageID, attachmentIDs); err == errInvalidAttachments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Error linking attachments: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
+		return
+	}
+
+	entities, mentionIDs, err := resolveMentions(tx, chatUUID, userUUID, req.Content, req.Mentions, isSecure)
+	if err == nil {
+		mentionIDs, err = storeMentions(tx, messageID, entities, mentionIDs)
+	}
+	if err != nil {
+		log.Printf("Error storing mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
+		return
+	}
+
+	preview := req.Content
+	if preview == "" {
+		preview = attachmentPreview
+	}
+	err = setChatLastMessage(tx, chatUUID, preview, now)
 
 	if err != nil {
 		log.Printf("Error updating chat last message: %v", err)
@@ -189,31 +674,71 @@ func SendMessageHandler(c *gin.Context) {
 	}
 
 	message := models.Message{
-		ID:             messageID,
-		ChatID:         chatUUID,
-		SenderID:       userUUID,
-		Content:        req.Content,
-		IsRead:         false,
-		IsDisappearing: req.IsDisappearing,
-		DisappearAfter: req.DisappearAfter,
-		SentAt:         now,
+		ID:              messageID,
+		ChatID:          chatUUID,
+		SenderID:        userUUID,
+		ClientMessageID: req.ClientMessageID,
+		Kind:            req.Kind,
+		Content:         req.Content,
+		Payload:         payload,
+		IsRead:          false,
+		Status:          ReceiptSent,
+		IsDisappearing:  req.IsDisappearing,
+		DisappearAfter:  req.DisappearAfter,
+		DisappearFrom:   req.DisappearFrom,
+		SentAt:          now,
+	}
+	if len(entities) > 0 {
+		message.Entities = entities
+	}
+	if expiresAt.Valid {
+		message.ExpiresAt = &expiresAt.Time
+	}
+	if len(attachmentIDs) > 0 {
+		page := []models.Message{message}
+		if err := fillAttachments(db.DB(), page); err != nil {
+			log.Printf("Error getting attachments: %v", err)
+		}
+		message = page[0]
+	}
+	if replyToID.Valid {
+		message.ReplyToID = &replyToID.UUID
+		message.ThreadRootID = &threadRootID.UUID
+
+		page := []models.Message{message}
+		if err := fillThreadInfo(db.DB(), userUUID, sql.NullTime{}, page); err != nil {
+			log.Printf("Error getting reply details: %v", err)
+		}
+		message = page[0]
 	}
 
+	response := message
+	downgradeKind(acceptedKinds(c), &response)
+
 	go func() {
 		payload := map[string]interface{}{
 			"message": message,
 			"sender":  sender,
 			"chatId":  chatID,
 		}
+		if message.ClientMessageID != "" {
+			payload["clientMessageId"] = message.ClientMessageID
+		}
 
 		wsMessage := WSMessage{
 			Type:    NewMessageType,
 			Payload: payload,
 		}
-		SendToChat(chatUUID, wsMessage, userID.(string))
+		delivered := SendToChat(chatUUID, wsMessage, userID.(string))
+		markDelivered(chatUUID, messageID, delivered)
+		notifyMentions(chatUUID, message, mentionIDs)
+
+		if threadRootID.Valid {
+			broadcastThreadUpdate(chatUUID, threadRootID.UUID, message)
+		}
 	}()
 
-	c.JSON(http.StatusCreated, message)
+	c.JSON(http.StatusCreated, response)
 }
 
 func UpdateMessageHandler(c *gin.Context) {
@@ -240,10 +765,14 @@ func UpdateMessageHandler(c *gin.Context) {
 
 	userUUID, _ := uuid.Parse(userID.(string))
 	var senderID uuid.UUID
+	var isSystem bool
+	var sentAt time.Time
+	var deletedAt sql.NullTime
+	var kind string
 	err = db.DB().QueryRow(`
-		SELECT sender_id FROM messages
+		SELECT sender_id, is_system, sent_at, deleted_at, kind FROM messages
 		WHERE id = $1 AND chat_id = $2
-	`, messageUUID, chatUUID).Scan(&senderID)
+	`, messageUUID, chatUUID).Scan(&senderID, &isSystem, &sentAt, &deletedAt, &kind)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
@@ -254,78 +783,248 @@ func UpdateMessageHandler(c *gin.Context) {
 		return
 	}
 
-	if senderID != userUUID {
+	if senderID != userUUID || isSystem {
 		c.JSON(http.StatusForbidden, gin.H{"error": "You can only update your own messages"})
 		return
 	}
 
+	if deletedAt.Valid {
+		c.JSON(http.StatusGone, gin.H{"error": "Message has been deleted"})
+		return
+	}
+
+	// The content of a location, contact or poll is the fallback for its
+	// payload and has to stay in step with it.
+	if kind != KindText && kind != KindAttachment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s messages cannot be edited", kind)})
+		return
+	}
+
+	if window := messageEditWindow(); window > 0 && time.Since(sentAt) > window {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Messages can only be edited within %v of sending", window)})
+		return
+	}
+
 	var req struct {
-		Content string `json:"content" binding:"required"`
+		Content  string    `json:"content" binding:"required"`
+		Mentions *[]string `json:"mentions"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	_, err = db.DB().Exec(`
-		UPDATE messages
-		SET content = $1
-		WHERE id = $2
-	`, req.Content, messageUUID)
 
+	var isSecure bool
+	err = db.DB().QueryRow(`SELECT is_secure FROM chats WHERE id = $1`, chatUUID).Scan(&isSecure)
+	if err != nil {
+		log.Printf("Error checking chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if isSecure {
+		if err := validateCipherEnvelope(req.Content); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The previous version is copied out under a row lock so concurrent
+	// edits each record the content they replaced.
+	var previous string
+	err = tx.QueryRow(`SELECT content FROM messages WHERE id = $1 FOR UPDATE`, messageUUID).Scan(&previous)
 	if err != nil {
-		log.Printf("Error updating message: %v", err)
+		log.Printf("Error locking message: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
 		return
 	}
 
-	var lastMessageID uuid.UUID
-	err = db.DB().QueryRow(`
-		SELECT id
-		FROM messages
-		WHERE chat_id = $1
-		ORDER BY sent_at DESC
-		LIMIT 1
-	`, chatUUID).Scan(&lastMessageID)
+	if previous != req.Content {
+		_, err = tx.Exec(`
+			INSERT INTO message_edits (message_id, content)
+			VALUES ($1, $2)
+		`, messageUUID, previous)
 
-	if err == nil && lastMessageID == messageUUID {
-		_, err = db.DB().Exec(`
-			UPDATE chats
-			SET last_message = $1
+		if err != nil {
+			log.Printf("Error recording message edit: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE messages
+			SET content = $1, edited_at = NOW()
 			WHERE id = $2
-		`, req.Content, chatUUID)
+		`, req.Content, messageUUID)
+
+		if err != nil {
+			log.Printf("Error updating message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+			return
+		}
+
+		var lastMessageID uuid.UUID
+		err = tx.QueryRow(`
+			SELECT id
+			FROM messages
+			WHERE chat_id = $1 AND deleted_at IS NULL
+			ORDER BY sent_at DESC
+			LIMIT 1
+		`, chatUUID).Scan(&lastMessageID)
+
+		if err == nil && lastMessageID == messageUUID {
+			_, err = tx.Exec(`
+				UPDATE chats
+				SET last_message = CASE WHEN is_secure THEN NULL ELSE $1 END
+				WHERE id = $2
+			`, req.Content, chatUUID)
+		}
 
 		if err != nil {
 			log.Printf("Error updating last message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+			return
 		}
 	}
 
-	var message models.Message
-	var disappearAfter sql.NullInt32
+	// Mentions follow the new content. Secure chat content can't be read
+	// here, so those keep their mentions unless the client sends a new list.
+	var mentionIDs []uuid.UUID
+	if (previous != req.Content && !isSecure) || req.Mentions != nil {
+		var explicit []string
+		if req.Mentions != nil {
+			explicit = *req.Mentions
+		}
 
-	err = db.DB().QueryRow(`
-		SELECT id, chat_id, sender_id, content, is_read, is_disappearing, 
-			   disappear_after, sent_at
-		FROM messages
-		WHERE id = $1
-	`, messageUUID).Scan(
-		&message.ID, &message.ChatID, &message.SenderID, &message.Content,
-		&message.IsRead, &message.IsDisappearing, &disappearAfter, &message.SentAt,
-	)
+		entities, mentioned, err := resolveMentions(tx, chatUUID, userUUID, req.Content, explicit, isSecure)
+		if err == nil {
+			mentionIDs, err = storeMentions(tx, messageUUID, entities, mentioned)
+		}
+		if err != nil {
+			log.Printf("Error storing mentions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+			return
+		}
+	}
 
+	message, err := getMessageByID(tx, messageUUID)
 	if err != nil {
 		log.Printf("Error getting updated message: %v", err)
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
 		return
 	}
 
-	if disappearAfter.Valid {
-		message.DisappearAfter = int(disappearAfter.Int32)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing message edit: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+		return
+	}
+
+	if previous != req.Content {
+		go SendToChat(chatUUID, WSMessage{
+			Type: UpdateMessageType,
+			Payload: map[string]interface{}{
+				"message": message,
+				"chatId":  chatID,
+			},
+		}, "")
+	}
+
+	if len(mentionIDs) > 0 {
+		go notifyMentions(chatUUID, message, mentionIDs)
 	}
 
 	c.JSON(http.StatusOK, message)
 }
 
+// GetMessageEditsHandler lists the previous versions of a message, oldest
+// first, to any member who can see the message.
+func GetMessageEditsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageUUID, err := uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	var visible bool
+	err = db.DB().QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM messages m WHERE `+messageVisibility+` AND m.id = $4)
+	`, chatUUID, clearedAt, userUUID, messageUUID).Scan(&visible)
+
+	if err != nil {
+		log.Printf("Error checking message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT id, message_id, content, edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY edited_at, id
+	`, messageUUID)
+	if err != nil {
+		log.Printf("Error getting message edits: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	edits := []models.MessageEdit{}
+	for rows.Next() {
+		var edit models.MessageEdit
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &edit.Content, &edit.EditedAt); err != nil {
+			log.Printf("Error scanning message edit: %v", err)
+			continue
+		}
+		edits = append(edits, edit)
+	}
+
+	c.JSON(http.StatusOK, edits)
+}
+
+// DeleteMessageHandler deletes a message for the caller only (scope=me) or,
+// by default, for everyone. Deleting for everyone leaves a tombstone that
+// records who deleted the message and when.
 func DeleteMessageHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -348,14 +1047,76 @@ func DeleteMessageHandler(c *gin.Context) {
 		return
 	}
 
+	scope := c.DefaultQuery("scope", "everyone")
+	if scope != "me" && scope != "everyone" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be 'me' or 'everyone'"})
+		return
+	}
+
 	userUUID, _ := uuid.Parse(userID.(string))
-	var senderID uuid.UUID
-	var isAdmin bool
 
+	var role string
+	var clearedAt sql.NullTime
 	err = db.DB().QueryRow(`
-		SELECT sender_id FROM messages
+		SELECT role, cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&role, &clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	if scope == "me" {
+		result, err := db.DB().Exec(`
+			INSERT INTO message_hidden (message_id, user_id)
+			SELECT m.id, $3 FROM messages m
+			WHERE `+messageVisibility+` AND m.id = $4
+			ON CONFLICT DO NOTHING
+		`, chatUUID, clearedAt, userUUID, messageUUID)
+
+		if err != nil {
+			log.Printf("Error hiding message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+			return
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+
+		// Only the caller's other sessions need to drop it.
+		go SendToUser(userID.(string), WSMessage{
+			Type: DeleteMessageType,
+			Payload: map[string]interface{}{
+				"chatId":     chatID,
+				"messageIds": []string{messageID},
+				"reason":     "hidden",
+			},
+		})
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var senderID uuid.UUID
+	var isSystem bool
+	var sentAt time.Time
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT sender_id, is_system, sent_at, deleted_at FROM messages
 		WHERE id = $1 AND chat_id = $2
-	`, messageUUID, chatUUID).Scan(&senderID)
+		FOR UPDATE
+	`, messageUUID, chatUUID).Scan(&senderID, &isSystem, &sentAt, &deletedAt)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
@@ -366,68 +1127,193 @@ func DeleteMessageHandler(c *gin.Context) {
 		return
 	}
 
-	var role string
-	err = db.DB().QueryRow(`
-		SELECT role FROM chat_members
-		WHERE chat_id = $1 AND user_id = $2
-	`, chatUUID, userUUID).Scan(&role)
+	isAdmin := isAdminRole(role)
+	if (senderID != userUUID || isSystem) && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only delete your own messages or need admin rights"})
+		return
+	}
 
-	if err == nil && role == "admin" {
-		isAdmin = true
+	if deletedAt.Valid {
+		c.JSON(http.StatusGone, gin.H{"error": "Message has already been deleted"})
+		return
 	}
 
-	if senderID != userUUID && !isAdmin {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You can only delete your own messages or need admin rights"})
+	if window := messageDeleteWindow(); !isAdmin && window > 0 && time.Since(sentAt) > window {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Messages can only be deleted for everyone within %v of sending", window)})
 		return
 	}
 
-	var content string
-	var sentAt time.Time
-	err = db.DB().QueryRow(`
-		SELECT content, sent_at FROM messages
+	_, err = tx.Exec(`
+		UPDATE messages
+		SET content = '', entities = NULL, payload = NULL, pinned_at = NULL, pinned_by = NULL,
+		    deleted_at = NOW(), deleted_by = $2
 		WHERE id = $1
-	`, messageUUID).Scan(&content, &sentAt)
+	`, messageUUID, userUUID)
 
 	if err != nil {
-		log.Printf("Error getting message details: %v", err)
+		log.Printf("Error deleting message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	// Earlier versions and reactions would otherwise survive the deletion.
+	if _, err := tx.Exec(`DELETE FROM message_edits WHERE message_id = $1`, messageUUID); err != nil {
+		log.Printf("Error deleting message edits: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM message_reactions WHERE message_id = $1`, messageUUID); err != nil {
+		log.Printf("Error deleting message reactions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM message_mentions WHERE message_id = $1`, messageUUID); err != nil {
+		log.Printf("Error deleting message mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	// Unlinked attachments are picked up by the attachment janitor.
+	if _, err := tx.Exec(`UPDATE attachments SET message_id = NULL WHERE message_id = $1`, messageUUID); err != nil {
+		log.Printf("Error detaching message attachments: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	if err := refreshChatLastMessage(tx, chatUUID); err != nil {
+		log.Printf("Error updating chat's last message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
 	}
 
-	_, err = db.DB().Exec(`DELETE FROM messages WHERE id = $1`, messageUUID)
+	tombstone, err := getMessageByID(tx, messageUUID)
 	if err != nil {
-		log.Printf("Error deleting message: %v", err)
+		log.Printf("Error getting deleted message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing message deletion: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
 		return
 	}
 
-	var lastMessageID uuid.UUID
+	go SendToChat(chatUUID, WSMessage{
+		Type: DeleteMessageType,
+		Payload: map[string]interface{}{
+			"chatId":     chatID,
+			"messageIds": []string{messageID},
+			"reason":     "deleted",
+			"message":    tombstone,
+		},
+	}, "")
+
+	c.JSON(http.StatusOK, tombstone)
+}
+
+// slowModeWait returns how long the user must still wait before posting in
+// the chat. The member row is locked so concurrent sends are serialised.
+func slowModeWait(tx *sql.Tx, chatID, userID uuid.UUID, interval time.Duration, now time.Time) (time.Duration, error) {
+	var lastSentAt sql.NullTime
+	err := tx.QueryRow(`
+		SELECT (SELECT MAX(sent_at) FROM messages
+				WHERE chat_id = $1 AND sender_id = $2 AND is_system = false)
+		FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+		FOR UPDATE
+	`, chatID, userID).Scan(&lastSentAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if !lastSentAt.Valid {
+		return 0, nil
+	}
+
+	return lastSentAt.Time.Add(interval).Sub(now), nil
+}
+
+// insertSystemMessage stores a server-generated notice in the chat and makes
+// it the chat's last message. actorID is recorded as the sender.
+func insertSystemMessage(tx *sql.Tx, chatID, actorID uuid.UUID, content string) (models.Message, error) {
+	message := models.Message{
+		ID:       uuid.New(),
+		ChatID:   chatID,
+		SenderID: actorID,
+		Kind:     KindSystem,
+		Content:  content,
+		IsSystem: true,
+		SentAt:   time.Now(),
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO messages (id, chat_id, sender_id, content, is_system, sent_at, kind)
+		VALUES ($1, $2, $3, $4, true, $5, 'system')
+	`, message.ID, chatID, actorID, content, message.SentAt)
+	if err != nil {
+		return message, err
+	}
+
+	err = setChatLastMessage(tx, chatID, content, message.SentAt)
+
+	return message, err
+}
+
+// refreshChatLastMessage points the chat's last-message fields at its newest
+// remaining message, or clears them when the chat is empty. Expired messages
+// the reaper has not reached yet do not count, and a disappearing message
+// only moves the timestamp so its text does not outlive it in the preview.
+func refreshChatLastMessage(q queryer, chatID uuid.UUID) error {
 	var lastMessageContent string
 	var lastMessageAt time.Time
+	var isDisappearing bool
 
-	err = db.DB().QueryRow(`
-		SELECT id, content, sent_at
+	err := q.QueryRow(`
+		SELECT content, sent_at, is_disappearing
 		FROM messages
-		WHERE chat_id = $1
-		ORDER BY sent_at DESC
+		WHERE chat_id = $1 AND deleted_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY sent_at DESC, id DESC
 		LIMIT 1
-	`, chatUUID).Scan(&lastMessageID, &lastMessageContent, &lastMessageAt)
+	`, chatID).Scan(&lastMessageContent, &lastMessageAt, &isDisappearing)
 
-	if err == nil {
-		_, err = db.DB().Exec(`
-			UPDATE chats
-			SET last_message = $1, last_message_at = $2
-			WHERE id = $3
-		`, lastMessageContent, lastMessageAt, chatUUID)
-	} else if err == sql.ErrNoRows {
-		_, err = db.DB().Exec(`
+	if err == sql.ErrNoRows {
+		_, err = q.Exec(`
 			UPDATE chats
 			SET last_message = NULL, last_message_at = NULL
 			WHERE id = $1
-		`, chatUUID)
+		`, chatID)
+		return err
+	} else if err != nil {
+		return err
 	}
 
-	if err != nil {
-		log.Printf("Error updating chat's last message: %v", err)
+	if isDisappearing {
+		_, err = q.Exec(`
+			UPDATE chats
+			SET last_message = NULL, last_message_at = $1
+			WHERE id = $2
+		`, lastMessageAt, chatID)
+		return err
+	}
+
+	if lastMessageContent == "" {
+		lastMessageContent = attachmentPreview
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	return setChatLastMessage(q, chatID, lastMessageContent, lastMessageAt)
+}
+
+// setChatLastMessage moves the chat's last-message marker. Secure chats only
+// get the timestamp; their content is never copied into the preview.
+func setChatLastMessage(q queryer, chatID uuid.UUID, content string, sentAt time.Time) error {
+	_, err := q.Exec(`
+		UPDATE chats
+		SET last_message = CASE WHEN is_secure THEN NULL ELSE $1 END, last_message_at = $2
+		WHERE id = $3
+	`, content, sentAt, chatID)
+	return err
 }
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// pinTarget checks that the caller is a chat admin and that the message in
+// the path is one they can see. It writes the error response itself and
+// reports whether the request may go on.
+func pinTarget(c *gin.Context) (chatID, messageID, userID uuid.UUID, ok bool) {
+	currentUserID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageID, err = uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userID, _ = uuid.Parse(currentUserID.(string))
+
+	var role string
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT role, cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatID, userID).Scan(&role, &clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	if !isAdminRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can pin messages"})
+		return
+	}
+
+	var isSystem bool
+	err = db.DB().QueryRow(`
+		SELECT m.is_system FROM messages m
+		WHERE `+messageVisibility+` AND m.id = $4 AND m.deleted_at IS NULL
+	`, chatID, clearedAt, userID, messageID).Scan(&isSystem)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error checking message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if isSystem {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "System messages cannot be pinned"})
+		return
+	}
+
+	return chatID, messageID, userID, true
+}
+
+// broadcastPinUpdate tells the chat that a message was pinned or unpinned,
+// followed by the system message for a pin.
+func broadcastPinUpdate(chatID uuid.UUID, message models.Message, userID uuid.UUID, systemMessage *models.Message) {
+	SendToChat(chatID, WSMessage{
+		Type: PinUpdateType,
+		Payload: map[string]interface{}{
+			"chatId":    chatID.String(),
+			"messageId": message.ID.String(),
+			"pinned":    message.IsPinned,
+			"userId":    userID.String(),
+			"message":   message,
+		},
+	}, "")
+
+	if systemMessage != nil {
+		SendToChat(chatID, WSMessage{
+			Type: NewMessageType,
+			Payload: map[string]interface{}{
+				"message": systemMessage,
+				"chatId":  chatID.String(),
+			},
+		}, "")
+	}
+}
+
+// PinMessageHandler pins a message to the top of its chat. Pinning an
+// already pinned message changes nothing and returns 200.
+func PinMessageHandler(c *gin.Context) {
+	chatID, messageID, userID, ok := pinTarget(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The chat row lock keeps concurrent pins from passing the limit.
+	var pinned int
+	err = tx.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM messages WHERE chat_id = $1 AND pinned_at IS NOT NULL)
+		FROM chats WHERE id = $1
+		FOR UPDATE
+	`, chatID).Scan(&pinned)
+	if err != nil {
+		log.Printf("Error counting pinned messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	result, err := tx.Exec(`
+		UPDATE messages SET pinned_at = NOW(), pinned_by = $2
+		WHERE id = $1 AND pinned_at IS NULL
+	`, messageID, userID)
+	if err != nil {
+		log.Printf("Error pinning message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin message"})
+		return
+	}
+
+	changed, _ := result.RowsAffected()
+	if changed > 0 && pinned >= maxPinnedMessages() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A chat can have at most %d pinned messages", maxPinnedMessages())})
+		return
+	}
+
+	var systemMessage *models.Message
+	if changed > 0 {
+		var actorName string
+		err = tx.QueryRow(`SELECT display_name FROM users WHERE id = $1`, userID).Scan(&actorName)
+		if err == nil {
+			var notice models.Message
+			notice, err = insertSystemMessage(tx, chatID, userID, fmt.Sprintf("%s pinned a message", actorName))
+			systemMessage = &notice
+		}
+		if err != nil {
+			log.Printf("Error creating pin notice: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin message"})
+			return
+		}
+	}
+
+	message, err := getMessageByID(tx, messageID)
+	if err != nil {
+		log.Printf("Error getting pinned message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin message"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pin: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin message"})
+		return
+	}
+
+	if changed == 0 {
+		c.JSON(http.StatusOK, message)
+		return
+	}
+
+	go broadcastPinUpdate(chatID, message, userID, systemMessage)
+
+	c.JSON(http.StatusCreated, message)
+}
+
+func UnpinMessageHandler(c *gin.Context) {
+	chatID, messageID, userID, ok := pinTarget(c)
+	if !ok {
+		return
+	}
+
+	result, err := db.DB().Exec(`
+		UPDATE messages SET pinned_at = NULL, pinned_by = NULL
+		WHERE id = $1 AND pinned_at IS NOT NULL
+	`, messageID)
+	if err != nil {
+		log.Printf("Error unpinning message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unpin message"})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message is not pinned"})
+		return
+	}
+
+	message, err := getMessageByID(db.DB(), messageID)
+	if err != nil {
+		log.Printf("Error getting unpinned message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	go broadcastPinUpdate(chatID, message, userID, nil)
+
+	c.JSON(http.StatusOK, message)
+}
+
+// GetPinnedMessagesHandler lists the chat's pinned messages that the caller
+// can see, most recently pinned first.
+func GetPinnedMessagesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT `+messageColumns+` FROM messages m
+		WHERE `+messageVisibility+` AND m.pinned_at IS NOT NULL AND m.deleted_at IS NULL
+		ORDER BY m.pinned_at DESC, m.id
+	`, chatUUID, clearedAt, userUUID)
+	if err != nil {
+		log.Printf("Error getting pinned messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("Error scanning pinned message: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	if err := fillThreadInfo(db.DB(), userUUID, clearedAt, messages); err != nil {
+		log.Printf("Error getting thread details: %v", err)
+	}
+
+	if err := fillReactions(db.DB(), userUUID, messages); err != nil {
+		log.Printf("Error getting reactions: %v", err)
+	}
+
+	if err := fillAttachments(db.DB(), messages); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	downgradeKinds(acceptedKinds(c), messages)
+
+	c.JSON(http.StatusOK, messages)
+}
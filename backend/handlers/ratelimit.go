@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenBucket is a per-key token bucket. Each key starts with burst tokens
+// and regains perMinute tokens per minute.
+type tokenBucket struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketState
+}
+
+type bucketState struct {
+	tokens  float64
+	updated time.Time
+}
+
+var messageRateLimiter = &tokenBucket{buckets: make(map[string]*bucketState)}
+
+// take consumes one token for key. When none is available it returns false
+// and how long until one will be.
+func (b *tokenBucket) take(key string, perMinute, burst int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+
+	rate := float64(perMinute) / 60
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.buckets[key]
+	if !ok {
+		state = &bucketState{tokens: float64(burst), updated: now}
+		b.buckets[key] = state
+	}
+
+	state.tokens = math.Min(float64(burst), state.tokens+now.Sub(state.updated).Seconds()*rate)
+	state.updated = now
+
+	if state.tokens >= 1 {
+		state.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - state.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops buckets that have been idle long enough to be full again.
+func (b *tokenBucket) prune(idle time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, state := range b.buckets {
+		if time.Since(state.updated) > idle {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// allowMessage applies the global per-user send rate, configured with
+// MESSAGE_RATE_PER_MINUTE and MESSAGE_RATE_BURST.
+func allowMessage(userID string) (bool, time.Duration) {
+	return messageRateLimiter.take(userID,
+		envInt("MESSAGE_RATE_PER_MINUTE", 30),
+		envInt("MESSAGE_RATE_BURST", 10))
+}
+
+// StartRateLimitJanitor periodically frees idle rate limit state.
+func StartRateLimitJanitor() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		messageRateLimiter.prune(10 * time.Minute)
+	}
+}
+
+func respondTooManyRequests(c *gin.Context, message string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retryAfter": seconds})
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const maxEmojiBytes = 32
+
+var errInvalidEmoji = errors.New("emoji must be a single emoji")
+
+// validateEmoji accepts short strings with no letters, digits, spaces or
+// control characters. That admits skin-tone and ZWJ sequences without
+// keeping a table of every emoji.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return errInvalidEmoji
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) ||
+			unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errInvalidEmoji
+		}
+	}
+	return nil
+}
+
+// fillReactions sets the aggregated reactions on a page of messages, marking
+// the ones the viewer has made.
+func fillReactions(q queryer, viewerID uuid.UUID, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	reactions, err := loadReactions(q, viewerID, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
+	return nil
+}
+
+func loadReactions(q queryer, viewerID uuid.UUID, messageIDs []uuid.UUID) (map[uuid.UUID][]models.Reaction, error) {
+	rows, err := q.Query(`
+		SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2)
+		FROM message_reactions
+		WHERE message_id = ANY($1::uuid[])
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji
+	`, pq.Array(uuidStrings(messageIDs)), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := map[uuid.UUID][]models.Reaction{}
+	for rows.Next() {
+		var messageID uuid.UUID
+		var reaction models.Reaction
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, err
+		}
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+
+	return reactions, rows.Err()
+}
+
+// reactionTarget parses the chat and message in the path and checks that the
+// caller can see the message. It writes the error response itself and
+// reports whether the request may go on.
+func reactionTarget(c *gin.Context) (chatID, messageID, userID uuid.UUID, ok bool) {
+	currentUserID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageID, err = uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userID, _ = uuid.Parse(currentUserID.(string))
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatID, userID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	var visible bool
+	err = db.DB().QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM messages m
+			WHERE `+messageVisibility+` AND m.id = $4 AND m.deleted_at IS NULL
+		)
+	`, chatID, clearedAt, userID, messageID).Scan(&visible)
+
+	if err != nil {
+		log.Printf("Error checking message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	return chatID, messageID, userID, true
+}
+
+// broadcastReactions sends a message's new reaction totals to the chat.
+// ReactedByMe is left false; clients work it out from userId and action.
+func broadcastReactions(chatID, messageID, userID uuid.UUID, emoji, action string, reactions []models.Reaction) {
+	reactions = nonNilReactions(reactions)
+	for i := range reactions {
+		reactions[i].ReactedByMe = false
+	}
+
+	SendToChat(chatID, WSMessage{
+		Type: ReactionType,
+		Payload: map[string]interface{}{
+			"chatId":    chatID.String(),
+			"messageId": messageID.String(),
+			"userId":    userID.String(),
+			"emoji":     emoji,
+			"action":    action,
+			"reactions": reactions,
+		},
+	}, "")
+}
+
+func AddReactionHandler(c *gin.Context) {
+	chatID, messageID, userID, ok := reactionTarget(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Emoji string `json:"emoji" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateEmoji(req.Emoji); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := db.DB().Exec(`
+		INSERT INTO message_reactions (message_id, user_id, emoji)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, messageID, userID, req.Emoji)
+
+	if err != nil {
+		log.Printf("Error adding reaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add reaction"})
+		return
+	}
+
+	reactions, err := loadReactions(db.DB(), userID, []uuid.UUID{messageID})
+	if err != nil {
+		log.Printf("Error getting reactions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	status := http.StatusOK
+	if n, _ := result.RowsAffected(); n > 0 {
+		status = http.StatusCreated
+		broadcast := append([]models.Reaction(nil), reactions[messageID]...)
+		go broadcastReactions(chatID, messageID, userID, req.Emoji, "added", broadcast)
+	}
+
+	c.JSON(status, gin.H{"messageId": messageID, "reactions": nonNilReactions(reactions[messageID])})
+}
+
+func RemoveReactionHandler(c *gin.Context) {
+	chatID, messageID, userID, ok := reactionTarget(c)
+	if !ok {
+		return
+	}
+
+	emoji := c.Param("emoji")
+
+	result, err := db.DB().Exec(`
+		DELETE FROM message_reactions
+		WHERE message_id = $1 AND user_id = $2 AND emoji = $3
+	`, messageID, userID, emoji)
+
+	if err != nil {
+		log.Printf("Error removing reaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove reaction"})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reaction not found"})
+		return
+	}
+
+	reactions, err := loadReactions(db.DB(), userID, []uuid.UUID{messageID})
+	if err != nil {
+		log.Printf("Error getting reactions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	broadcast := append([]models.Reaction(nil), reactions[messageID]...)
+	go broadcastReactions(chatID, messageID, userID, emoji, "removed", broadcast)
+
+	c.JSON(http.StatusOK, gin.H{"messageId": messageID, "reactions": nonNilReactions(reactions[messageID])})
+}
+
+func nonNilReactions(reactions []models.Reaction) []models.Reaction {
+	if reactions == nil {
+		return []models.Reaction{}
+	}
+	return reactions
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Receipt states shown on the sender's copy of a message.
+const (
+	ReceiptSent      = "sent"
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// markReceipts records that userID has received, and if read is set also
+// read, the given messages in chatID. Only other members' messages are
+// affected. The senders of messages whose state changed are told over
+// WebSocket; read state is reported as delivered for users who have turned
+// read receipts off.
+func markReceipts(chatID, userID uuid.UUID, messageIDs []uuid.UUID, read bool) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	rows, err := db.DB().Query(`
+		WITH changed AS (
+			INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+			SELECT m.id, $2, NOW(), CASE WHEN $4 THEN NOW() END
+			FROM messages m
+			WHERE m.id = ANY($1::uuid[]) AND m.chat_id = $3 AND m.sender_id != $2
+			  AND EXISTS (SELECT 1 FROM chat_members cm WHERE cm.chat_id = $3 AND cm.user_id = $2)
+			ON CONFLICT (message_id, user_id) DO UPDATE SET read_at = EXCLUDED.read_at
+			WHERE message_receipts.read_at IS NULL AND EXCLUDED.read_at IS NOT NULL
+			RETURNING message_id
+		)
+		SELECT c.message_id, m.sender_id, u.read_receipts
+		FROM changed c
+		JOIN messages m ON m.id = c.message_id
+		JOIN users u ON u.id = $2
+	`, pq.Array(uuidStrings(messageIDs)), userID, chatID, read)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	bySender := map[uuid.UUID][]string{}
+	sharesReads := true
+	for rows.Next() {
+		var messageID, senderID uuid.UUID
+		if err := rows.Scan(&messageID, &senderID, &sharesReads); err != nil {
+			return err
+		}
+		bySender[senderID] = append(bySender[senderID], messageID.String())
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	status := ReceiptDelivered
+	if read && sharesReads {
+		status = ReceiptRead
+	}
+
+	now := time.Now()
+	for senderID, ids := range bySender {
+		SendToUser(senderID.String(), WSMessage{
+			Type: ReceiptUpdateType,
+			Payload: map[string]interface{}{
+				"chatId":     chatID.String(),
+				"messageIds": ids,
+				"userId":     userID.String(),
+				"status":     status,
+				"at":         now,
+			},
+		})
+	}
+
+	return nil
+}
+
+// markDelivered records delivery of a freshly sent message to the members it
+// was pushed to over WebSocket, in one statement however many there are. A
+// receipt row always carries delivered_at, so existing rows are left alone.
+func markDelivered(chatID, messageID uuid.UUID, userIDs []string) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		WITH changed AS (
+			INSERT INTO message_receipts (message_id, user_id, delivered_at)
+			SELECT m.id, r.user_id, NOW()
+			FROM unnest($2::uuid[]) AS r(user_id)
+			JOIN messages m ON m.id = $1 AND m.chat_id = $3 AND m.sender_id != r.user_id
+			JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id = r.user_id
+			ON CONFLICT (message_id, user_id) DO NOTHING
+			RETURNING user_id
+		)
+		SELECT c.user_id, m.sender_id
+		FROM changed c
+		JOIN messages m ON m.id = $1
+	`, messageID, pq.Array(userIDs), chatID)
+	if err != nil {
+		log.Printf("Error recording delivery of message %s: %v", messageID, err)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var userID, senderID uuid.UUID
+		if err := rows.Scan(&userID, &senderID); err != nil {
+			log.Printf("Error recording delivery of message %s: %v", messageID, err)
+			return
+		}
+
+		SendToUser(senderID.String(), WSMessage{
+			Type: ReceiptUpdateType,
+			Payload: map[string]interface{}{
+				"chatId":     chatID.String(),
+				"messageIds": []string{messageID.String()},
+				"userId":     userID.String(),
+				"status":     ReceiptDelivered,
+				"at":         now,
+			},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error recording delivery of message %s: %v", messageID, err)
+	}
+}
+
+// handleReceiptAck applies a "receipt" message sent by a client over
+// WebSocket.
+func handleReceiptAck(userID string, payload interface{}) {
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return
+	}
+
+	chatIDStr, _ := fields["chatId"].(string)
+	chatUUID, err := uuid.Parse(chatIDStr)
+	if err != nil {
+		return
+	}
+
+	status, _ := fields["status"].(string)
+	if status != ReceiptDelivered && status != ReceiptRead {
+		return
+	}
+
+	rawIDs, _ := fields["messageIds"].([]interface{})
+	messageIDs := []uuid.UUID{}
+	for _, raw := range rawIDs {
+		if s, ok := raw.(string); ok {
+			if id, err := uuid.Parse(s); err == nil {
+				messageIDs = append(messageIDs, id)
+			}
+		}
+	}
+
+	read := status == ReceiptRead
+	if err := markReceipts(chatUUID, userUUID, messageIDs, read); err != nil {
+		log.Printf("Error recording receipts from user %s: %v", userID, err)
+		return
+	}
+
+	if read {
+		if _, err := startReadTimers(db.DB(), userUUID, messageIDs); err != nil {
+			log.Printf("Error starting disappearing timers: %v", err)
+		}
+	}
+}
+
+// fillReceiptStatus sets Status and IsRead on a page of messages as seen by
+// viewerID. The viewer's own messages get the aggregate state across the
+// other members; everyone else's report whether the viewer has read them.
+func fillReceiptStatus(q queryer, viewerID uuid.UUID, messages []models.Message) error {
+	own := []uuid.UUID{}
+	others := []uuid.UUID{}
+	for _, message := range messages {
+		if message.IsSystem {
+			continue
+		}
+		if message.SenderID == viewerID {
+			own = append(own, message.ID)
+		} else {
+			others = append(others, message.ID)
+		}
+	}
+
+	status := map[uuid.UUID]string{}
+
+	if len(own) > 0 {
+		rows, err := q.Query(`
+			SELECT m.id,
+			       COUNT(cm.user_id),
+			       COUNT(r.delivered_at),
+			       COUNT(r.read_at) FILTER (WHERE u.read_receipts)
+			FROM messages m
+			JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id != m.sender_id
+			JOIN users u ON u.id = cm.user_id
+			LEFT JOIN message_receipts r ON r.message_id = m.id AND r.user_id = cm.user_id
+			WHERE m.id = ANY($1::uuid[])
+			GROUP BY m.id
+		`, pq.Array(uuidStrings(own)))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			var recipients, delivered, read int
+			if err := rows.Scan(&id, &recipients, &delivered, &read); err != nil {
+				rows.Close()
+				return err
+			}
+			switch {
+			case read == recipients:
+				status[id] = ReceiptRead
+			case delivered == recipients:
+				status[id] = ReceiptDelivered
+			default:
+				status[id] = ReceiptSent
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	readByViewer := map[uuid.UUID]bool{}
+	if len(others) > 0 {
+		rows, err := q.Query(`
+			SELECT message_id FROM message_receipts
+			WHERE message_id = ANY($1::uuid[]) AND user_id = $2 AND read_at IS NOT NULL
+		`, pq.Array(uuidStrings(others)), viewerID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			readByViewer[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		if message.IsSystem {
+			continue
+		}
+		if message.SenderID == viewerID {
+			// A chat with no other members has nobody to deliver to.
+			message.Status = status[message.ID]
+			if message.Status == "" {
+				message.Status = ReceiptSent
+			}
+			message.IsRead = message.Status == ReceiptRead
+		} else {
+			message.IsRead = readByViewer[message.ID]
+		}
+	}
+
+	return nil
+}
+
+// GetMessageReceiptsHandler lists per-member delivery and read state for one
+// of the caller's own messages.
+func GetMessageReceiptsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageUUID, err := uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var senderID uuid.UUID
+	err = db.DB().QueryRow(`
+		SELECT sender_id FROM messages WHERE id = $1 AND chat_id = $2
+	`, messageUUID, chatUUID).Scan(&senderID)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting message for receipts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if senderID != userUUID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view receipts for your own messages"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT u.id, u.display_name, r.delivered_at,
+		       CASE WHEN u.read_receipts THEN r.read_at END
+		FROM chat_members cm
+		JOIN users u ON u.id = cm.user_id
+		LEFT JOIN message_receipts r ON r.message_id = $1 AND r.user_id = cm.user_id
+		WHERE cm.chat_id = $2 AND cm.user_id != $3
+		ORDER BY u.display_name, u.id
+	`, messageUUID, chatUUID, userUUID)
+	if err != nil {
+		log.Printf("Error getting message receipts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	receipts := []models.MessageReceipt{}
+	for rows.Next() {
+		var receipt models.MessageReceipt
+		var deliveredAt, readAt sql.NullTime
+		if err := rows.Scan(&receipt.UserID, &receipt.DisplayName, &deliveredAt, &readAt); err != nil {
+			log.Printf("Error scanning message receipt: %v", err)
+			continue
+		}
+
+		receipt.Status = ReceiptSent
+		if deliveredAt.Valid {
+			receipt.Status = ReceiptDelivered
+			receipt.DeliveredAt = &deliveredAt.Time
+		}
+		if readAt.Valid {
+			receipt.Status = ReceiptRead
+			receipt.ReadAt = &readAt.Time
+		}
+
+		receipts = append(receipts, receipt)
+	}
+
+	c.JSON(http.StatusOK, receipts)
+}
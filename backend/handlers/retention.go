@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	"qrconnect-backend/db"
+
+	"github.com/google/uuid"
+)
+
+const maxRetentionDays = 3650
+
+// retentionMetrics is published at /debug/vars under "retention".
+var retentionMetrics = expvar.NewMap("retention")
+
+// StartRetentionWorker periodically deletes messages older than their chat's
+// retention_days. RETENTION_PURGE_INTERVAL and RETENTION_BATCH_SIZE tune how
+// often it runs and how many rows each transaction removes.
+func StartRetentionWorker() {
+	interval := envDuration("RETENTION_PURGE_INTERVAL", time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purgeExpiredMessages(envInt("RETENTION_BATCH_SIZE", 500))
+		<-ticker.C
+	}
+}
+
+func purgeExpiredMessages(batchSize int) {
+	started := time.Now()
+	retentionMetrics.Add("runs", 1)
+
+	rows, err := db.DB().Query(`
+		SELECT id, retention_days
+		FROM chats
+		WHERE retention_days > 0
+		  AND last_message_at IS NOT NULL
+	`)
+	if err != nil {
+		log.Printf("Error listing chats for retention purge: %v", err)
+		retentionMetrics.Add("errors", 1)
+		return
+	}
+
+	type policy struct {
+		chatID uuid.UUID
+		days   int
+	}
+	policies := []policy{}
+	for rows.Next() {
+		var p policy
+		if err := rows.Scan(&p.chatID, &p.days); err != nil {
+			log.Printf("Error scanning retention policy: %v", err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+
+	for _, p := range policies {
+		cutoff := started.AddDate(0, 0, -p.days)
+		for {
+			deleted, err := purgeChatBatch(p.chatID, cutoff, batchSize)
+			if err != nil {
+				log.Printf("Error purging messages in chat %s: %v", p.chatID, err)
+				retentionMetrics.Add("errors", 1)
+				break
+			}
+			if deleted < batchSize {
+				break
+			}
+		}
+		retentionMetrics.Add("chatsProcessed", 1)
+	}
+
+	retentionMetrics.Set("lastRunUnix", expvarInt(started.Unix()))
+	retentionMetrics.Set("lastRunMillis", expvarInt(time.Since(started).Milliseconds()))
+}
+
+// purgeChatBatch deletes up to batchSize messages sent before cutoff and
+// repairs the chat's last-message fields in the same transaction.
+func purgeChatBatch(chatID uuid.UUID, cutoff time.Time, batchSize int) (int, error) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM messages
+		WHERE id IN (
+			SELECT id FROM messages
+			WHERE chat_id = $1 AND sent_at < $2
+			ORDER BY sent_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id
+	`, chatID, cutoff, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	deletedIDs := []string{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deletedIDs = append(deletedIDs, id.String())
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(deletedIDs) == 0 {
+		return 0, nil
+	}
+
+	if err := refreshChatLastMessage(tx, chatID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	retentionMetrics.Add("messagesDeleted", int64(len(deletedIDs)))
+
+	SendToChat(chatID, WSMessage{
+		Type: DeleteMessageType,
+		Payload: map[string]interface{}{
+			"chatId":     chatID.String(),
+			"messageIds": deletedIDs,
+			"reason":     "retention",
+		},
+	}, "")
+
+	return len(deletedIDs), nil
+}
+
+func expvarInt(n int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(n)
+	return v
+}
@@ -0,0 +1,789 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// maxScheduleAttempts is how often delivery of a scheduled message is tried
+// before it is given up on.
+const maxScheduleAttempts = 5
+
+// schedulerMetrics is published at /debug/vars under "scheduler".
+var schedulerMetrics = expvar.NewMap("scheduler")
+
+// Scheduled message events sent to the sender's own sessions.
+const (
+	ScheduledCreated   = "created"
+	ScheduledUpdated   = "updated"
+	ScheduledCancelled = "cancelled"
+	ScheduledSent      = "sent"
+	ScheduledFailed    = "failed"
+)
+
+const scheduledColumns = `s.id, s.chat_id, s.sender_id, COALESCE(s.client_message_id, ''), s.content,
+	s.is_disappearing, s.disappear_after, COALESCE(s.disappear_mode, ''), s.reply_to_id, s.mentions,
+	s.send_at, s.created_at, s.updated_at, s.kind, s.payload`
+
+func scanScheduledMessage(row rowScanner) (models.ScheduledMessage, error) {
+	var scheduled models.ScheduledMessage
+	var disappearAfter sql.NullInt32
+	var replyToID uuid.NullUUID
+	var mentions []string
+	var payload []byte
+
+	err := row.Scan(
+		&scheduled.ID, &scheduled.ChatID, &scheduled.SenderID, &scheduled.ClientMessageID, &scheduled.Content,
+		&scheduled.IsDisappearing, &disappearAfter, &scheduled.DisappearFrom, &replyToID, pq.Array(&mentions),
+		&scheduled.SendAt, &scheduled.CreatedAt, &scheduled.UpdatedAt, &scheduled.Kind, &payload,
+	)
+	if err != nil {
+		return scheduled, err
+	}
+
+	if disappearAfter.Valid {
+		scheduled.DisappearAfter = int(disappearAfter.Int32)
+	}
+
+	if replyToID.Valid {
+		scheduled.ReplyToID = &replyToID.UUID
+	}
+
+	if len(payload) > 0 {
+		scheduled.Payload = payload
+	}
+
+	scheduled.Mentions = mentions
+	return scheduled, nil
+}
+
+// validateSendAt checks that a scheduled time is in the future and no
+// further ahead than SCHEDULE_MAX_AHEAD.
+func validateSendAt(sendAt time.Time) error {
+	if !sendAt.After(time.Now()) {
+		return errors.New("sendAt must be in the future")
+	}
+	if ahead := envDuration("SCHEDULE_MAX_AHEAD", 365*24*time.Hour); time.Until(sendAt) > ahead {
+		return fmt.Errorf("sendAt cannot be more than %v ahead", ahead)
+	}
+	return nil
+}
+
+// reserveAttachments ties uploads to a scheduled message so the attachment
+// janitor leaves them alone until it is delivered or cancelled.
+func reserveAttachments(tx *sql.Tx, chatID, senderID, scheduledID uuid.UUID, attachmentIDs []uuid.UUID) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		UPDATE attachments
+		SET scheduled_message_id = $1
+		WHERE id = ANY($2::uuid[]) AND chat_id = $3 AND uploader_id = $4
+		  AND message_id IS NULL AND linked_at IS NULL AND scheduled_message_id IS NULL
+	`, scheduledID, pq.Array(uuidStrings(attachmentIDs)), chatID, senderID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); int(n) != len(attachmentIDs) {
+		return errInvalidAttachments
+	}
+	return nil
+}
+
+// fillScheduledAttachments sets the reserved attachments on scheduled
+// messages.
+func fillScheduledAttachments(q queryer, scheduled []models.ScheduledMessage) error {
+	if len(scheduled) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(scheduled))
+	index := map[uuid.UUID]int{}
+	for i, s := range scheduled {
+		ids[i] = s.ID
+		index[s.ID] = i
+	}
+
+	rows, err := q.Query(`
+		SELECT id, chat_id, scheduled_message_id, uploader_id, file_name, content_type, size_bytes, created_at
+		FROM attachments
+		WHERE scheduled_message_id = ANY($1::uuid[])
+		ORDER BY created_at, id
+	`, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment models.Attachment
+		var scheduledID uuid.UUID
+		err := rows.Scan(&attachment.ID, &attachment.ChatID, &scheduledID, &attachment.UploaderID,
+			&attachment.FileName, &attachment.ContentType, &attachment.Size, &attachment.CreatedAt)
+		if err != nil {
+			return err
+		}
+		attachment.URL = attachmentURL(attachment.ChatID, attachment.ID)
+
+		s := &scheduled[index[scheduledID]]
+		s.Attachments = append(s.Attachments, attachment)
+	}
+
+	return rows.Err()
+}
+
+// notifyScheduled keeps the sender's other sessions in step with their
+// scheduled messages.
+func notifyScheduled(senderID uuid.UUID, action string, scheduled models.ScheduledMessage) {
+	SendToUser(senderID.String(), WSMessage{
+		Type: ScheduledMessageType,
+		Payload: map[string]interface{}{
+			"chatId":    scheduled.ChatID.String(),
+			"action":    action,
+			"scheduled": scheduled,
+		},
+	})
+}
+
+// scheduleMessage stores a send request that SendMessageHandler has already
+// validated for delivery at scheduled.SendAt. A concurrent retry with the
+// same clientMessageId gets the pending message with 200.
+func scheduleMessage(c *gin.Context, scheduled models.ScheduledMessage, attachmentIDs []uuid.UUID) {
+	if err := validateSendAt(scheduled.SendAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	var disappearAfter sql.NullInt32
+	if scheduled.IsDisappearing {
+		disappearAfter = sql.NullInt32{Int32: int32(scheduled.DisappearAfter), Valid: true}
+	}
+
+	stored, err := scanScheduledMessage(tx.QueryRow(`
+		INSERT INTO scheduled_messages AS s (id, chat_id, sender_id, client_message_id, content,
+			is_disappearing, disappear_after, disappear_mode, reply_to_id, mentions, send_at, kind, payload)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12, $13)
+		ON CONFLICT (chat_id, sender_id, client_message_id) WHERE client_message_id IS NOT NULL DO NOTHING
+		RETURNING `+scheduledColumns,
+		scheduled.ID, scheduled.ChatID, scheduled.SenderID, scheduled.ClientMessageID, scheduled.Content,
+		scheduled.IsDisappearing, disappearAfter, scheduled.DisappearFrom, scheduled.ReplyToID,
+		pq.Array(scheduled.Mentions), scheduled.SendAt, scheduled.Kind, payloadValue(scheduled.Payload)))
+
+	// A concurrent retry got there first.
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		if !replayScheduledMessage(c, scheduled.ChatID, scheduled.SenderID, scheduled.ClientMessageID) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule message"})
+		}
+		return
+	}
+
+	if err == nil {
+		err = reserveAttachments(tx, scheduled.ChatID, scheduled.SenderID, scheduled.ID, attachmentIDs)
+	}
+	if err == errInvalidAttachments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		log.Printf("Error scheduling message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule message"})
+		return
+	}
+
+	page := []models.ScheduledMessage{stored}
+	if err := fillScheduledAttachments(db.DB(), page); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+	stored = page[0]
+
+	go notifyScheduled(stored.SenderID, ScheduledCreated, stored)
+
+	c.JSON(http.StatusCreated, stored)
+}
+
+// replayScheduledMessage answers a retried send that was stored for later
+// delivery with the pending message and 200. It reports whether it wrote a
+// response.
+func replayScheduledMessage(c *gin.Context, chatID, senderID uuid.UUID, clientMessageID string) bool {
+	scheduled, err := scanScheduledMessage(db.DB().QueryRow(`
+		SELECT `+scheduledColumns+` FROM scheduled_messages s
+		WHERE s.chat_id = $1 AND s.sender_id = $2 AND s.client_message_id = $3
+	`, chatID, senderID, clientMessageID))
+
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Printf("Error checking client message ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return true
+	}
+
+	page := []models.ScheduledMessage{scheduled}
+	if err := fillScheduledAttachments(db.DB(), page); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	c.JSON(http.StatusOK, page[0])
+	return true
+}
+
+// GetScheduledMessagesHandler lists the caller's pending messages in a chat,
+// soonest first. Nobody else can see them.
+func GetScheduledMessagesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	if _, err := getMemberRole(db.DB(), chatUUID, userUUID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	rows, err := db.DB().Query(`
+		SELECT `+scheduledColumns+` FROM scheduled_messages s
+		WHERE s.chat_id = $1 AND s.sender_id = $2
+		ORDER BY s.send_at, s.id
+	`, chatUUID, userUUID)
+	if err != nil {
+		log.Printf("Error getting scheduled messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	scheduled := []models.ScheduledMessage{}
+	for rows.Next() {
+		s, err := scanScheduledMessage(rows)
+		if err != nil {
+			log.Printf("Error scanning scheduled message: %v", err)
+			continue
+		}
+		scheduled = append(scheduled, s)
+	}
+
+	if err := fillScheduledAttachments(db.DB(), scheduled); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	c.JSON(http.StatusOK, scheduled)
+}
+
+// UpdateScheduledMessageHandler changes the content, mentions or time of one
+// of the caller's pending messages. Once it has been delivered it is an
+// ordinary message and this returns 404.
+func UpdateScheduledMessageHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	scheduledUUID, err := uuid.Parse(c.Param("scheduledId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var req struct {
+		Content  *string    `json:"content"`
+		Mentions *[]string  `json:"mentions"`
+		SendAt   *time.Time `json:"sendAt"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.SendAt != nil {
+		if err := validateSendAt(*req.SendAt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Waits for the scheduler if it is delivering this message right now.
+	scheduled, err := scanScheduledMessage(tx.QueryRow(`
+		SELECT `+scheduledColumns+` FROM scheduled_messages s
+		WHERE s.id = $1 AND s.chat_id = $2 AND s.sender_id = $3
+		FOR UPDATE
+	`, scheduledUUID, chatUUID, userUUID))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting scheduled message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if req.Content != nil && *req.Content != scheduled.Content && scheduled.Kind != KindText && scheduled.Kind != KindAttachment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The content of %s messages cannot be edited", scheduled.Kind)})
+		return
+	}
+
+	if req.Content != nil {
+		scheduled.Content = *req.Content
+	}
+	if req.Mentions != nil {
+		scheduled.Mentions = *req.Mentions
+	}
+	if req.SendAt != nil {
+		scheduled.SendAt = *req.SendAt
+	}
+
+	if scheduled.Content == "" {
+		var attachments int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM attachments WHERE scheduled_message_id = $1`, scheduledUUID).Scan(&attachments)
+		if err != nil {
+			log.Printf("Error counting attachments: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if attachments == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A message needs content or attachments"})
+			return
+		}
+	}
+
+	var isSecure bool
+	err = tx.QueryRow(`SELECT is_secure FROM chats WHERE id = $1`, chatUUID).Scan(&isSecure)
+	if err != nil {
+		log.Printf("Error checking chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if isSecure && scheduled.Content != "" {
+		if err := validateCipherEnvelope(scheduled.Content); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	scheduled, err = scanScheduledMessage(tx.QueryRow(`
+		UPDATE scheduled_messages s
+		SET content = $1, mentions = $2, send_at = $3, attempts = 0, updated_at = NOW()
+		WHERE s.id = $4
+		RETURNING `+scheduledColumns,
+		scheduled.Content, pq.Array(scheduled.Mentions), scheduled.SendAt, scheduledUUID))
+
+	if err != nil {
+		log.Printf("Error updating scheduled message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update scheduled message"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing scheduled message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update scheduled message"})
+		return
+	}
+
+	page := []models.ScheduledMessage{scheduled}
+	if err := fillScheduledAttachments(db.DB(), page); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	go notifyScheduled(userUUID, ScheduledUpdated, page[0])
+
+	c.JSON(http.StatusOK, page[0])
+}
+
+// CancelScheduledMessageHandler drops one of the caller's pending messages.
+// Its attachments are left for the attachment janitor.
+func CancelScheduledMessageHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	scheduledUUID, err := uuid.Parse(c.Param("scheduledId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	scheduled, err := scanScheduledMessage(db.DB().QueryRow(`
+		DELETE FROM scheduled_messages s
+		WHERE s.id = $1 AND s.chat_id = $2 AND s.sender_id = $3
+		RETURNING `+scheduledColumns,
+		scheduledUUID, chatUUID, userUUID))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error cancelling scheduled message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled message"})
+		return
+	}
+
+	go notifyScheduled(userUUID, ScheduledCancelled, scheduled)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// StartMessageScheduler periodically delivers scheduled messages that are
+// due. Pending messages live in the database and each is claimed with
+// SKIP LOCKED, so nothing is lost across restarts and several instances can
+// run the scheduler at once. SCHEDULER_INTERVAL and SCHEDULER_BATCH_SIZE tune
+// how often it runs and how many messages one run delivers.
+func StartMessageScheduler() {
+	interval := envDuration("SCHEDULER_INTERVAL", 5*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deliverDueMessages(envInt("SCHEDULER_BATCH_SIZE", 100))
+		<-ticker.C
+	}
+}
+
+func deliverDueMessages(batchSize int) {
+	started := time.Now()
+	schedulerMetrics.Add("runs", 1)
+
+	for i := 0; i < batchSize; i++ {
+		delivered, err := deliverDueMessage()
+		if err != nil {
+			log.Printf("Error delivering scheduled message: %v", err)
+			schedulerMetrics.Add("errors", 1)
+			break
+		}
+		if !delivered {
+			break
+		}
+	}
+
+	schedulerMetrics.Set("lastRunUnix", expvarInt(started.Unix()))
+}
+
+// deliverDueMessage turns the most overdue scheduled message into a real one
+// and reports whether there was one to handle. Messages from senders who can
+// no longer post in the chat are dropped. A message that keeps failing is
+// tried after the others and dropped after maxScheduleAttempts.
+func deliverDueMessage() (bool, error) {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var attempts int
+	scheduled, err := scanScheduledMessage(searchRow{tx.QueryRow(`
+		SELECT ` + scheduledColumns + `, s.attempts FROM scheduled_messages s
+		WHERE s.send_at <= NOW()
+		ORDER BY s.attempts, s.send_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`), []interface{}{&attempts}})
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if attempts >= maxScheduleAttempts {
+		return true, dropScheduled(tx, scheduled)
+	}
+
+	message, mentionIDs, err := storeScheduledMessage(tx, scheduled)
+	if err == errScheduledDropped {
+		return true, dropScheduled(tx, scheduled)
+	} else if err != nil {
+		tx.Rollback()
+		if _, markErr := db.DB().Exec(`
+			UPDATE scheduled_messages SET attempts = attempts + 1 WHERE id = $1
+		`, scheduled.ID); markErr != nil {
+			log.Printf("Error recording failed delivery: %v", markErr)
+		}
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	schedulerMetrics.Add("delivered", 1)
+
+	page := []models.Message{message}
+	if err := fillAttachments(db.DB(), page); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+	if err := fillThreadInfo(db.DB(), message.SenderID, sql.NullTime{}, page); err != nil {
+		log.Printf("Error getting reply details: %v", err)
+	}
+	message = page[0]
+
+	go fanOutScheduled(scheduled, message, mentionIDs)
+
+	return true, nil
+}
+
+var errScheduledDropped = errors.New("scheduled message can no longer be delivered")
+
+// storeScheduledMessage inserts the message for a due scheduled message the
+// same way SendMessageHandler would, with the chat's settings as they are
+// now. A message those settings no longer allow is dropped.
+func storeScheduledMessage(tx *sql.Tx, scheduled models.ScheduledMessage) (models.Message, []uuid.UUID, error) {
+	var role, chatType string
+	var isSecure bool
+	var defaultDisappearAfter sql.NullInt32
+	err := tx.QueryRow(`
+		SELECT cm.role, c.chat_type, c.is_secure, c.default_disappear_after
+		FROM chat_members cm
+		JOIN chats c ON c.id = cm.chat_id
+		WHERE cm.chat_id = $1 AND cm.user_id = $2
+	`, scheduled.ChatID, scheduled.SenderID).Scan(&role, &chatType, &isSecure, &defaultDisappearAfter)
+
+	if err == sql.ErrNoRows {
+		return models.Message{}, nil, errScheduledDropped
+	} else if err != nil {
+		return models.Message{}, nil, err
+	}
+
+	if chatType == ChatTypeAnnouncement && !isAdminRole(role) {
+		return models.Message{}, nil, errScheduledDropped
+	}
+
+	now := time.Now()
+	message := models.Message{
+		ID:              scheduled.ID,
+		ChatID:          scheduled.ChatID,
+		SenderID:        scheduled.SenderID,
+		ClientMessageID: scheduled.ClientMessageID,
+		Kind:            scheduled.Kind,
+		Content:         scheduled.Content,
+		Payload:         scheduled.Payload,
+		Status:          ReceiptSent,
+		IsDisappearing:  scheduled.IsDisappearing,
+		DisappearAfter:  scheduled.DisappearAfter,
+		DisappearFrom:   scheduled.DisappearFrom,
+		SentAt:          now,
+	}
+
+	if chatTimer := effectiveDisappearAfter(isSecure, defaultDisappearAfter); chatTimer > 0 {
+		if !message.IsDisappearing {
+			message.DisappearFrom = DisappearFromSent
+		}
+		message.IsDisappearing = true
+		if message.DisappearAfter <= 0 || message.DisappearAfter > chatTimer {
+			message.DisappearAfter = chatTimer
+		}
+	}
+
+	var expiresAt sql.NullTime
+	if message.DisappearFrom == DisappearFromSent {
+		expiresAt = sql.NullTime{Time: now.Add(time.Duration(message.DisappearAfter) * time.Second), Valid: true}
+		message.ExpiresAt = &expiresAt.Time
+	}
+
+	var attachmentIDs []uuid.UUID
+	rows, err := tx.Query(`SELECT id FROM attachments WHERE scheduled_message_id = $1`, scheduled.ID)
+	if err != nil {
+		return message, nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return message, nil, err
+		}
+		attachmentIDs = append(attachmentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return message, nil, err
+	}
+
+	// Attachments may have been removed with the chat in the meantime.
+	if message.Content == "" && len(attachmentIDs) == 0 {
+		return message, nil, errScheduledDropped
+	}
+
+	// The chat may have been made secure, or plain, since the message was
+	// scheduled. A secure chat takes only ciphertext and no payloads, and
+	// ciphertext means nothing in a plain chat.
+	if message.Content != "" && (validateCipherEnvelope(message.Content) == nil) != isSecure {
+		return message, nil, errScheduledDropped
+	}
+	if _, _, err := validateMessageKind(message.Kind, message.Payload, len(attachmentIDs) > 0, isSecure); err != nil {
+		return message, nil, errScheduledDropped
+	}
+
+	// The reply is kept only if its parent is still there.
+	var replyToID, threadRootID uuid.NullUUID
+	if scheduled.ReplyToID != nil {
+		rootID, err := resolveReplyTarget(tx, scheduled.ChatID, *scheduled.ReplyToID)
+		if err == nil {
+			replyToID = uuid.NullUUID{UUID: *scheduled.ReplyToID, Valid: true}
+			threadRootID = uuid.NullUUID{UUID: rootID, Valid: true}
+			message.ReplyToID = &replyToID.UUID
+			message.ThreadRootID = &threadRootID.UUID
+		} else if err != errInvalidReplyTarget {
+			return message, nil, err
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO messages (id, chat_id, sender_id, content, is_read, is_disappearing, disappear_after,
+			disappear_mode, expires_at, reply_to_id, thread_root_id, sent_at, client_message_id, kind, payload)
+		VALUES ($1, $2, $3, $4, false, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, NULLIF($12, ''), $13, $14)
+		ON CONFLICT DO NOTHING
+	`, message.ID, message.ChatID, message.SenderID, message.Content, message.IsDisappearing,
+		message.DisappearAfter, message.DisappearFrom, expiresAt, replyToID, threadRootID, now,
+		message.ClientMessageID, message.Kind, payloadValue(message.Payload))
+	if err != nil {
+		return message, nil, err
+	}
+
+	// The same clientMessageId was already sent directly.
+	if n, _ := result.RowsAffected(); n == 0 {
+		return message, nil, errScheduledDropped
+	}
+
+	if err := linkAttachments(tx, message.ChatID, message.SenderID, message.ID, attachmentIDs); err != nil {
+		return message, nil, err
+	}
+
+	entities, mentionIDs, err := resolveMentions(tx, message.ChatID, message.SenderID, message.Content,
+		scheduled.Mentions, isSecure)
+	if err == nil {
+		mentionIDs, err = storeMentions(tx, message.ID, entities, mentionIDs)
+	}
+	if err != nil {
+		return message, nil, err
+	}
+	if len(entities) > 0 {
+		message.Entities = entities
+	}
+
+	preview := message.Content
+	if preview == "" {
+		preview = attachmentPreview
+	}
+	if err := setChatLastMessage(tx, message.ChatID, preview, now); err != nil {
+		return message, nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM scheduled_messages WHERE id = $1`, scheduled.ID); err != nil {
+		return message, nil, err
+	}
+
+	return message, mentionIDs, nil
+}
+
+// dropScheduled removes a scheduled message that cannot be delivered and
+// tells its sender.
+func dropScheduled(tx *sql.Tx, scheduled models.ScheduledMessage) error {
+	if _, err := tx.Exec(`DELETE FROM scheduled_messages WHERE id = $1`, scheduled.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	schedulerMetrics.Add("dropped", 1)
+	go notifyScheduled(scheduled.SenderID, ScheduledFailed, scheduled)
+	return nil
+}
+
+// fanOutScheduled sends a delivered scheduled message out like a direct
+// send. The sender's own sessions get it too, since none of them has it yet.
+func fanOutScheduled(scheduled models.ScheduledMessage, message models.Message, mentionIDs []uuid.UUID) {
+	var sender models.User
+	err := db.DB().QueryRow(`
+		SELECT id, username, display_name, profile_picture, created_at, updated_at
+		FROM users
+		WHERE id = $1
+	`, message.SenderID).Scan(&sender.ID, &sender.Username, &sender.DisplayName, &sender.ProfilePicture,
+		&sender.CreatedAt, &sender.UpdatedAt)
+
+	if err != nil {
+		log.Printf("Error getting sender details: %v", err)
+	}
+
+	payload := map[string]interface{}{
+		"message":     message,
+		"sender":      sender,
+		"chatId":      message.ChatID.String(),
+		"scheduledId": scheduled.ID.String(),
+	}
+	if message.ClientMessageID != "" {
+		payload["clientMessageId"] = message.ClientMessageID
+	}
+
+	delivered := SendToChat(message.ChatID, WSMessage{Type: NewMessageType, Payload: payload}, "")
+	markDelivered(message.ChatID, message.ID, delivered)
+	notifyMentions(message.ChatID, message, mentionIDs)
+	notifyScheduled(message.SenderID, ScheduledSent, scheduled)
+
+	if message.ThreadRootID != nil {
+		broadcastThreadUpdate(message.ChatID, *message.ThreadRootID, message)
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	maxSearchQueryLength  = 256
+
+	// ts_headline marks matches with these control characters; they are
+	// swapped for <mark> tags after the rest of the snippet is escaped.
+	highlightStart = "\x01"
+	highlightStop  = "\x02"
+)
+
+// SearchMessagesHandler searches every chat the caller belongs to.
+func SearchMessagesHandler(c *gin.Context) {
+	searchMessages(c, uuid.Nil)
+}
+
+// SearchChatMessagesHandler searches a single chat.
+func SearchChatMessagesHandler(c *gin.Context) {
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	searchMessages(c, chatUUID)
+}
+
+// searchMessages runs a full-text query over the messages the caller can see,
+// newest first. Results are paged with the cursor in X-Next-Cursor. Secure
+// chats and disappearing messages are never indexed, so never match.
+func searchMessages(c *gin.Context, chatID uuid.UUID) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	if len(q) > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("q cannot exceed %d characters", maxSearchQueryLength)})
+		return
+	}
+
+	if chatID != uuid.Nil {
+		if _, err := getMemberRole(db.DB(), chatID, userUUID); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+			return
+		}
+	}
+
+	limit := parseLimit(c, defaultSearchPageSize, maxSearchPageSize)
+
+	query := `
+		SELECT ` + messageColumns + `, c.name, COALESCE(u.display_name, ''),
+		       ts_headline('simple', m.content, tsq,
+		           'StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, MaxWords=30, MinWords=10, MaxFragments=2')
+		FROM messages m
+		CROSS JOIN websearch_to_tsquery('simple', $1) tsq
+		JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id = $2
+		JOIN chats c ON c.id = m.chat_id
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE m.search_vector @@ tsq
+		  AND NOT c.is_secure
+		  AND NOT m.is_disappearing
+		  AND m.deleted_at IS NULL
+		  AND (cm.cleared_at IS NULL OR m.sent_at > cm.cleared_at)
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $2)`
+	args := []interface{}{q, userUUID}
+	argIndex := 3
+
+	if chatID != uuid.Nil {
+		query += fmt.Sprintf(" AND m.chat_id = $%d", argIndex)
+		args = append(args, chatID)
+		argIndex++
+	}
+
+	if sender := c.Query("senderId"); sender != "" {
+		senderUUID, err := uuid.Parse(sender)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sender ID"})
+			return
+		}
+		query += fmt.Sprintf(" AND m.sender_id = $%d", argIndex)
+		args = append(args, senderUUID)
+		argIndex++
+	}
+
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": bound.param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		query += fmt.Sprintf(" AND m.sent_at %s $%d", bound.op, argIndex)
+		args = append(args, t)
+		argIndex++
+	}
+
+	switch c.Query("hasAttachment") {
+	case "":
+	case "true":
+		query += " AND EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id)"
+	case "false":
+		query += " AND NOT EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id)"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hasAttachment must be true or false"})
+		return
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		cursorAt, cursorID, err := decodeCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query += fmt.Sprintf(" AND (m.sent_at, m.id) < ($%d, $%d)", argIndex, argIndex+1)
+		args = append(args, cursorAt, cursorID)
+		argIndex += 2
+	}
+
+	query += fmt.Sprintf(" ORDER BY m.sent_at DESC, m.id DESC LIMIT $%d", argIndex)
+	args = append(args, limit+1)
+
+	rows, err := db.DB().Query(query, args...)
+	if err != nil {
+		log.Printf("Error searching messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	kinds := acceptedKinds(c)
+	results := []models.SearchResult{}
+	for rows.Next() {
+		var result models.SearchResult
+		var snippet string
+		message, err := scanMessage(searchRow{rows, []interface{}{&result.ChatName, &result.SenderName, &snippet}})
+		if err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		downgradeKind(kinds, &message)
+		result.Message = message
+		result.Snippet = highlightSnippet(snippet)
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error searching messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[len(results)-1].Message
+		c.Header(NextCursorHeader, encodeCursor(last.SentAt, last.ID))
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// searchRow lets scanMessage read a row that has extra columns after the
+// message ones.
+type searchRow struct {
+	rows  rowScanner
+	extra []interface{}
+}
+
+func (r searchRow) Scan(dest ...interface{}) error {
+	return r.rows.Scan(append(dest, r.extra...)...)
+}
+
+// highlightSnippet escapes a ts_headline result for HTML and turns the match
+// markers into <mark> tags.
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// cipherEnvelope is the only message content accepted in secure chats. The
+// server never sees the key; it only checks that the content is shaped like
+// ciphertext rather than plaintext.
+type cipherEnvelope struct {
+	Version    int    `json:"v"`
+	Algorithm  string `json:"alg"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ct"`
+}
+
+const cipherEnvelopeVersion = 1
+
+var errNotCiphertext = errors.New(`secure chats only accept encrypted content: {"v":1,"alg":"...","nonce":"<base64>","ct":"<base64>"}`)
+
+func validateCipherEnvelope(content string) error {
+	var envelope cipherEnvelope
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil {
+		return errNotCiphertext
+	}
+
+	if envelope.Version != cipherEnvelopeVersion || envelope.Algorithm == "" {
+		return errNotCiphertext
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(envelope.Nonce); err != nil || envelope.Nonce == "" {
+		return errNotCiphertext
+	}
+
+	if ct, err := base64.StdEncoding.DecodeString(envelope.Ciphertext); err != nil || len(ct) == 0 {
+		return errNotCiphertext
+	}
+
+	return nil
+}
+
+// effectiveDisappearAfter resolves a chat's default disappearing timer in
+// seconds. Secure chats that never chose one get SECURE_DISAPPEAR_AFTER.
+func effectiveDisappearAfter(isSecure bool, configured sql.NullInt32) int {
+	if configured.Valid {
+		return int(configured.Int32)
+	}
+	if isSecure {
+		return envInt("SECURE_DISAPPEAR_AFTER", 7*24*60*60)
+	}
+	return 0
+}
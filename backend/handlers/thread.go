@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"qrconnect-backend/db"
+	"qrconnect-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultThreadPageSize = 50
+	maxThreadPageSize     = 200
+	quoteSnippetLength    = 120
+)
+
+var errInvalidReplyTarget = errors.New("replyToId must be a message in this chat")
+
+// resolveReplyTarget checks that parentID is a live message in chatID and
+// returns the root of the thread a reply to it belongs to.
+func resolveReplyTarget(q queryer, chatID, parentID uuid.UUID) (uuid.UUID, error) {
+	var rootID uuid.UUID
+	err := q.QueryRow(`
+		SELECT COALESCE(thread_root_id, id) FROM messages
+		WHERE id = $1 AND chat_id = $2 AND deleted_at IS NULL
+	`, parentID, chatID).Scan(&rootID)
+
+	if err == sql.ErrNoRows {
+		return uuid.Nil, errInvalidReplyTarget
+	}
+	return rootID, err
+}
+
+// quoteSnippet shortens a parent message for display with a reply. Secure
+// chat content is ciphertext, which is useless once cut, so it is kept whole.
+func quoteSnippet(content string, isSecure bool) string {
+	if isSecure {
+		return content
+	}
+	runes := []rune(content)
+	if len(runes) <= quoteSnippetLength {
+		return content
+	}
+	return string(runes[:quoteSnippetLength]) + "…"
+}
+
+// fillThreadInfo sets the reply quote on replies and the reply and
+// per-viewer unread counts on thread roots. clearedAt is the viewer's
+// cleared_at in the chat; parents the viewer cleared or hid are quoted
+// without their content.
+func fillThreadInfo(q queryer, viewerID uuid.UUID, clearedAt sql.NullTime, messages []models.Message) error {
+	parents := []uuid.UUID{}
+	roots := []uuid.UUID{}
+	for _, message := range messages {
+		if message.ReplyToID != nil {
+			parents = append(parents, *message.ReplyToID)
+		}
+		if message.ThreadRootID == nil && !message.IsSystem {
+			roots = append(roots, message.ID)
+		}
+	}
+
+	quotes := map[uuid.UUID]*models.MessageQuote{}
+	if len(parents) > 0 {
+		rows, err := q.Query(`
+			SELECT m.id, m.sender_id, COALESCE(u.display_name, ''), m.content,
+			       m.deleted_at IS NOT NULL, m.is_disappearing, c.is_secure,
+			       ($3::timestamptz IS NULL OR m.sent_at > $3) AND h.message_id IS NULL
+			FROM messages m
+			JOIN chats c ON c.id = m.chat_id
+			LEFT JOIN users u ON u.id = m.sender_id
+			LEFT JOIN message_hidden h ON h.message_id = m.id AND h.user_id = $2
+			WHERE m.id = ANY($1::uuid[])
+		`, pq.Array(uuidStrings(parents)), viewerID, clearedAt)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var quote models.MessageQuote
+			var content string
+			var isDisappearing, isSecure, visible bool
+			err := rows.Scan(&quote.ID, &quote.SenderID, &quote.SenderName, &content,
+				&quote.IsDeleted, &isDisappearing, &isSecure, &visible)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			// A disappearing parent must not live on inside its replies, nor
+			// one the viewer has cleared or hidden.
+			if visible && !quote.IsDeleted && !isDisappearing {
+				quote.Snippet = quoteSnippet(content, isSecure)
+			}
+			quotes[quote.ID] = &quote
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	type threadCounts struct {
+		replies int
+		unread  int
+	}
+	counts := map[uuid.UUID]threadCounts{}
+	if len(roots) > 0 {
+		rows, err := q.Query(`
+			SELECT r.thread_root_id, COUNT(*),
+			       COUNT(*) FILTER (WHERE r.sender_id != $2 AND r.sent_at > COALESCE(tr.last_read_at, '-infinity'))
+			FROM messages r
+			LEFT JOIN thread_reads tr ON tr.root_id = r.thread_root_id AND tr.user_id = $2
+			WHERE r.thread_root_id = ANY($1::uuid[])
+			  AND r.deleted_at IS NULL
+			  AND (r.expires_at IS NULL OR r.expires_at > NOW())
+			GROUP BY r.thread_root_id
+		`, pq.Array(uuidStrings(roots)), viewerID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var rootID uuid.UUID
+			var tc threadCounts
+			if err := rows.Scan(&rootID, &tc.replies, &tc.unread); err != nil {
+				rows.Close()
+				return err
+			}
+			counts[rootID] = tc
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		if message.ReplyToID != nil {
+			message.ReplyTo = quotes[*message.ReplyToID]
+		}
+		if tc, ok := counts[message.ID]; ok {
+			message.ReplyCount = tc.replies
+			message.ThreadUnreadCount = tc.unread
+		}
+	}
+
+	return nil
+}
+
+// broadcastThreadUpdate tells the chat that a thread gained a reply.
+func broadcastThreadUpdate(chatID, rootID uuid.UUID, reply models.Message) {
+	var replyCount int
+	err := db.DB().QueryRow(`
+		SELECT COUNT(*) FROM messages
+		WHERE thread_root_id = $1 AND deleted_at IS NULL
+	`, rootID).Scan(&replyCount)
+	if err != nil {
+		log.Printf("Error counting thread replies: %v", err)
+		return
+	}
+
+	SendToChat(chatID, WSMessage{
+		Type: ThreadUpdateType,
+		Payload: map[string]interface{}{
+			"chatId":      chatID.String(),
+			"rootId":      rootID.String(),
+			"replyCount":  replyCount,
+			"lastReplyAt": reply.SentAt,
+			"message":     reply,
+		},
+	}, "")
+}
+
+// GetThreadHandler returns a thread's root message and a page of its
+// replies, oldest first. It takes the same before/after cursors and limit as
+// GetMessagesHandler and marks the returned replies as read.
+func GetThreadHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	chatUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageUUID, err := uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	var clearedAt sql.NullTime
+	err = db.DB().QueryRow(`
+		SELECT cleared_at FROM chat_members
+		WHERE chat_id = $1 AND user_id = $2
+	`, chatUUID, userUUID).Scan(&clearedAt)
+
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		return
+	}
+
+	// Asking for the thread of a reply opens the thread it belongs to.
+	var rootID uuid.UUID
+	err = db.DB().QueryRow(`
+		SELECT COALESCE(m.thread_root_id, m.id) FROM messages m
+		WHERE `+messageVisibility+` AND m.id = $4
+	`, chatUUID, clearedAt, userUUID, messageUUID).Scan(&rootID)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error getting thread root: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// The thread stays reachable through its replies when the root is not
+	// visible to the viewer, who then gets a placeholder without content.
+	root, err := scanMessage(db.DB().QueryRow(`
+		SELECT `+messageColumns+` FROM messages m
+		WHERE `+messageVisibility+` AND m.id = $4
+	`, chatUUID, clearedAt, userUUID, rootID))
+
+	rootVisible := err == nil
+	if err == sql.ErrNoRows {
+		root = models.Message{ID: rootID, ChatID: chatUUID, Kind: KindText}
+	} else if err != nil {
+		log.Printf("Error getting thread root: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	limit := parseLimit(c, defaultThreadPageSize, maxThreadPageSize)
+	threadRoot := uuid.NullUUID{UUID: rootID, Valid: true}
+
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use only one of before or after"})
+		return
+	}
+
+	var anchorAt time.Time
+	var anchorID uuid.UUID
+	if anchor := before + after; anchor != "" {
+		anchorID, err = uuid.Parse(anchor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+			return
+		}
+
+		err = db.DB().QueryRow(`
+			SELECT m.sent_at FROM messages m
+			WHERE `+messageVisibility+` AND m.id = $4 AND m.thread_root_id = $5
+		`, chatUUID, clearedAt, userUUID, anchorID, rootID).Scan(&anchorAt)
+
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		} else if err != nil {
+			log.Printf("Error getting cursor message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	var replies []models.Message
+	var hasOlder, hasNewer bool
+
+	if after != "" {
+		replies, err = messagePage(chatUUID, userUUID, clearedAt, threadRoot, ">", anchorAt, anchorID, false, limit+1)
+		if err == nil {
+			hasNewer = len(replies) > limit
+			if hasNewer {
+				replies = replies[:limit]
+			}
+			hasOlder = true
+		}
+	} else {
+		cursor := ""
+		if before != "" {
+			cursor = "<"
+			hasNewer = true
+		}
+		replies, err = messagePage(chatUUID, userUUID, clearedAt, threadRoot, cursor, anchorAt, anchorID, true, limit+1)
+		if err == nil {
+			hasOlder = len(replies) > limit
+			if hasOlder {
+				replies = replies[:limit]
+			}
+			reverseMessages(replies)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error getting thread replies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if len(replies) > 0 {
+		if hasOlder {
+			c.Header(NextCursorHeader, replies[0].ID.String())
+		}
+		if hasNewer {
+			c.Header(PrevCursorHeader, replies[len(replies)-1].ID.String())
+		}
+
+		markPageRead(chatUUID, userUUID, replies)
+		if err := markThreadRead(chatUUID, rootID, userUUID, replies); err != nil {
+			log.Printf("Error marking thread as read: %v", err)
+		}
+	}
+
+	if err := fillReceiptStatus(db.DB(), userUUID, replies); err != nil {
+		log.Printf("Error getting receipt status: %v", err)
+	}
+
+	page := append([]models.Message{root}, replies...)
+	if err := fillThreadInfo(db.DB(), userUUID, clearedAt, page); err != nil {
+		log.Printf("Error getting thread details: %v", err)
+	}
+
+	filled := page
+	if !rootVisible {
+		filled = page[1:]
+	}
+
+	if err := fillReactions(db.DB(), userUUID, filled); err != nil {
+		log.Printf("Error getting reactions: %v", err)
+	}
+
+	if err := fillAttachments(db.DB(), filled); err != nil {
+		log.Printf("Error getting attachments: %v", err)
+	}
+
+	downgradeKinds(acceptedKinds(c), page)
+
+	c.JSON(http.StatusOK, gin.H{
+		"root":    page[0],
+		"replies": page[1:],
+	})
+}
+
+// markThreadRead moves the viewer's read marker for a thread forward to the
+// newest of the given replies and tells the viewer's other sessions.
+func markThreadRead(chatID, rootID, userID uuid.UUID, replies []models.Message) error {
+	newest := replies[0].SentAt
+	for _, reply := range replies {
+		if reply.SentAt.After(newest) {
+			newest = reply.SentAt
+		}
+	}
+
+	var lastReadAt time.Time
+	err := db.DB().QueryRow(`
+		INSERT INTO thread_reads (root_id, user_id, last_read_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (root_id, user_id)
+		DO UPDATE SET last_read_at = GREATEST(thread_reads.last_read_at, EXCLUDED.last_read_at)
+		RETURNING last_read_at
+	`, rootID, userID, newest).Scan(&lastReadAt)
+	if err != nil {
+		return err
+	}
+
+	go SendToUser(userID.String(), WSMessage{
+		Type: ThreadReadType,
+		Payload: map[string]interface{}{
+			"chatId":     chatID.String(),
+			"rootId":     rootID.String(),
+			"lastReadAt": lastReadAt,
+		},
+	})
+
+	return nil
+}
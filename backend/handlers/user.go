@@ -22,13 +22,14 @@ func GetUserProfileHandler(c *gin.Context) {
 
 	var user models.User
 	var profilePicture sql.NullString
+	var readReceipts bool
 	err = db.DB().QueryRow(`
-		SELECT id, username, display_name, profile_picture, created_at, updated_at
+		SELECT id, username, display_name, profile_picture, created_at, updated_at, read_receipts
 		FROM users
 		WHERE id = $1
 	`, userUUID).Scan(
 		&user.ID, &user.Username, &user.DisplayName,
-		&profilePicture, &user.CreatedAt, &user.UpdatedAt,
+		&profilePicture, &user.CreatedAt, &user.UpdatedAt, &readReceipts,
 	)
 
 	if err == sql.ErrNoRows {
@@ -44,6 +45,11 @@ func GetUserProfileHandler(c *gin.Context) {
 		user.ProfilePicture = profilePicture.String
 	}
 
+	// Privacy settings are only shown to their owner.
+	if currentUserID, _ := c.Get("userID"); currentUserID == userID {
+		user.ReadReceipts = &readReceipts
+	}
+
 	c.JSON(http.StatusOK, user)
 }
 
@@ -70,6 +76,7 @@ func UpdateUserProfileHandler(c *gin.Context) {
 	type UpdateProfileRequest struct {
 		DisplayName    *string `json:"displayName"`
 		ProfilePicture *string `json:"profilePicture"`
+		ReadReceipts   *bool   `json:"readReceipts"`
 	}
 
 	var req UpdateProfileRequest
@@ -106,15 +113,30 @@ func UpdateUserProfileHandler(c *gin.Context) {
 		}
 	}
 
+	if req.ReadReceipts != nil {
+		_, err = db.DB().Exec(`
+			UPDATE users
+			SET read_receipts = $1
+			WHERE id = $2
+		`, *req.ReadReceipts, userUUID)
+
+		if err != nil {
+			log.Printf("Error updating read receipts setting: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+	}
+
 	var user models.User
 	var profilePicture sql.NullString
+	var readReceipts bool
 	err = db.DB().QueryRow(`
-		SELECT id, username, display_name, profile_picture, created_at, updated_at
+		SELECT id, username, display_name, profile_picture, created_at, updated_at, read_receipts
 		FROM users
 		WHERE id = $1
 	`, userUUID).Scan(
 		&user.ID, &user.Username, &user.DisplayName,
-		&profilePicture, &user.CreatedAt, &user.UpdatedAt,
+		&profilePicture, &user.CreatedAt, &user.UpdatedAt, &readReceipts,
 	)
 
 	if err != nil {
@@ -126,6 +148,7 @@ func UpdateUserProfileHandler(c *gin.Context) {
 	if profilePicture.Valid {
 		user.ProfilePicture = profilePicture.String
 	}
+	user.ReadReceipts = &readReceipts
 
 	c.JSON(http.StatusOK, user)
 }
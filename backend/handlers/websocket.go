@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"qrconnect-backend/auth"
+	"qrconnect-backend/models"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +25,11 @@ var (
 	}
 	clients      = make(map[string][]*websocket.Conn)
 	clientsMutex = sync.RWMutex{}
+
+	// connKinds holds the message kinds each connection said it understands
+	// with the "kinds" query parameter. Connections that didn't say get
+	// every kind.
+	connKinds = make(map[*websocket.Conn]map[string]bool)
 )
 
 const (
@@ -32,6 +38,19 @@ const (
 	DeleteMessageType = "delete_message"
 	ChatUpdateType    = "chat_update"
 	ChatDeleteType    = "chat_delete"
+	ChatCreatedType   = "chat_created"
+
+	MemberJoinedType       = "member_joined"
+	JoinRequestType        = "join_request"
+	JoinRequestDecidedType = "join_request_decided"
+
+	ReceiptUpdateType    = "receipt_update"
+	ThreadUpdateType     = "thread_update"
+	ThreadReadType       = "thread_read"
+	ReactionType         = "reaction_update"
+	MentionType          = "mention"
+	PinUpdateType        = "pin_update"
+	ScheduledMessageType = "scheduled_message"
 )
 
 type WSMessage struct {
@@ -71,7 +90,7 @@ func HandleWebSocket(c *gin.Context) {
 
 	log.Printf("WebSocket connected for user: %s", userID)
 
-	addClient(userID, conn)
+	addClient(userID, conn, parseKinds(c.Query("kinds")))
 
 	welcomeMsg := WSMessage{
 		Type: "connected",
@@ -86,10 +105,14 @@ func HandleWebSocket(c *gin.Context) {
 	go handleMessages(userID, conn)
 }
 
-func addClient(userID string, conn *websocket.Conn) {
+func addClient(userID string, conn *websocket.Conn, kinds map[string]bool) {
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
 
+	if kinds != nil {
+		connKinds[conn] = kinds
+	}
+
 	if _, ok := clients[userID]; !ok {
 		clients[userID] = make([]*websocket.Conn, 0)
 	}
@@ -102,6 +125,8 @@ func removeClient(userID string, conn *websocket.Conn) {
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
 
+	delete(connKinds, conn)
+
 	if conns, ok := clients[userID]; ok {
 		for i, c := range conns {
 			if c == conn {
@@ -183,6 +208,11 @@ func handleMessages(userID string, conn *websocket.Conn) {
 				}
 			}
 
+		case "receipt":
+			// Clients acknowledge messages with
+			// {"chatId": "...", "messageIds": [...], "status": "delivered"|"read"}.
+			handleReceiptAck(userID, msg.Payload)
+
 		case "unsubscribe":
 
 			if payload, ok := msg.Payload.(map[string]interface{}); ok {
@@ -203,36 +233,70 @@ func handleMessages(userID string, conn *websocket.Conn) {
 	}
 }
 
-func SendToUser(userID string, message WSMessage) {
+// SendToUser sends a message to each of the user's connections and reports
+// whether any of them took it.
+func SendToUser(userID string, message WSMessage) bool {
 	clientsMutex.RLock()
-	conns, ok := clients[userID]
-	clientsMutex.RUnlock()
-
-	if !ok {
-		return
+	conns := clients[userID]
+	kinds := make([]map[string]bool, len(conns))
+	for i, conn := range conns {
+		kinds[i] = connKinds[conn]
 	}
+	clientsMutex.RUnlock()
 
-	for _, conn := range conns {
-		if err := sendWSMessage(conn, message); err != nil {
+	sent := false
+	for i, conn := range conns {
+		if err := sendWSMessage(conn, downgradeEvent(kinds[i], message)); err != nil {
 			log.Printf("Error sending to user %s: %v", userID, err)
+			continue
 		}
+		sent = true
 	}
+	return sent
 }
 
-func SendToChat(chatID uuid.UUID, message WSMessage, excludeUserID string) {
-
-	members, err := getChatMembers(chatID)
+// SendToChat delivers a message to every connected member of a chat and
+// returns the users it was sent to. When the chat has more members than there
+// are connected users, as in a large announcement channel, it walks the
+// connections instead of the members.
+func SendToChat(chatID uuid.UUID, message WSMessage, excludeUserID string) []string {
+	memberIDs, err := cachedChatMemberIDs(chatID)
 	if err != nil {
 		log.Printf("Error getting chat members: %v", err)
-		return
+		return nil
 	}
 
-	for _, member := range members {
-		userID := member.ID.String()
-		if userID != excludeUserID {
-			SendToUser(userID, message)
+	clientsMutex.RLock()
+	var recipients []string
+	if len(memberIDs) > len(clients) {
+		for userID := range clients {
+			if _, ok := memberIDs[userID]; ok {
+				recipients = append(recipients, userID)
+			}
+		}
+	} else {
+		for userID := range memberIDs {
+			if _, ok := clients[userID]; ok {
+				recipients = append(recipients, userID)
+			}
 		}
 	}
+	clientsMutex.RUnlock()
+
+	return SendToUsers(recipients, message, excludeUserID)
+}
+
+// SendToUsers delivers a message to a fixed list of users, for events sent
+// after the chat's membership rows are gone. It returns the users at least
+// one of whose connections took the message.
+func SendToUsers(userIDs []string, message WSMessage, excludeUserID string) []string {
+	sent := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID != excludeUserID && SendToUser(userID, message) {
+			sent = append(sent, userID)
+		}
+	}
+	return sent
 }
 
 func sendWSMessage(conn *websocket.Conn, message WSMessage) error {
@@ -242,3 +306,37 @@ func sendWSMessage(conn *websocket.Conn, message WSMessage) error {
 	}
 	return conn.WriteMessage(websocket.TextMessage, data)
 }
+
+// downgradeEvent applies a connection's kind list to the message carried by
+// an event, leaving the shared event itself untouched.
+func downgradeEvent(kinds map[string]bool, event WSMessage) WSMessage {
+	payload, ok := event.Payload.(map[string]interface{})
+	if kinds == nil || !ok {
+		return event
+	}
+
+	var message models.Message
+	switch m := payload["message"].(type) {
+	case models.Message:
+		message = m
+	case *models.Message:
+		if m == nil {
+			return event
+		}
+		message = *m
+	default:
+		return event
+	}
+
+	if kinds[message.Kind] {
+		return event
+	}
+
+	downgradeKind(kinds, &message)
+	copied := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		copied[k] = v
+	}
+	copied["message"] = message
+	return WSMessage{Type: event.Type, Payload: copied}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"expvar"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -22,13 +24,19 @@ func main() {
 	db.InitDB()
 	log.Println("Database connection initialized")
 
+	go handlers.StartRateLimitJanitor()
+	go handlers.StartRetentionWorker()
+	go handlers.StartDisappearingReaper()
+	go handlers.StartAttachmentJanitor()
+	go handlers.StartMessageScheduler()
+
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		ExposeHeaders:    []string{"Content-Length", handlers.NextCursorHeader, handlers.PrevCursorHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -56,24 +64,84 @@ func main() {
 			chats.POST("", handlers.AuthMiddleware(), handlers.CreateChatHandler)
 			chats.PATCH("/:id", handlers.AuthMiddleware(), handlers.UpdateChatHandler)
 			chats.DELETE("/:id", handlers.AuthMiddleware(), handlers.DeleteChatHandler)
+			chats.GET("/:id/history", handlers.AuthMiddleware(), handlers.GetChatEditHistoryHandler)
+			chats.GET("/:id/export", handlers.AuthMiddleware(), handlers.ExportChatHandler)
+			chats.GET("/:id/avatar", handlers.AuthMiddleware(), handlers.GetChatAvatarHandler)
+			chats.POST("/:id/avatar", handlers.AuthMiddleware(), handlers.UploadChatAvatarHandler)
+			chats.DELETE("/:id/avatar", handlers.AuthMiddleware(), handlers.DeleteChatAvatarHandler)
+
+			chats.GET("/:id/invites", handlers.AuthMiddleware(), handlers.GetInvitesHandler)
+			chats.POST("/:id/invites", handlers.AuthMiddleware(), handlers.CreateInviteHandler)
+			chats.DELETE("/:id/invites/:inviteId", handlers.AuthMiddleware(), handlers.RevokeInviteHandler)
+			chats.GET("/:id/join-requests", handlers.AuthMiddleware(), handlers.GetJoinRequestsHandler)
+			chats.POST("/:id/join-requests/:requestId/approve", handlers.AuthMiddleware(), handlers.ApproveJoinRequestHandler)
+			chats.POST("/:id/join-requests/:requestId/reject", handlers.AuthMiddleware(), handlers.RejectJoinRequestHandler)
 
 			chats.GET("/:id/messages", handlers.AuthMiddleware(), handlers.GetMessagesHandler)
 			chats.POST("/:id/messages", handlers.AuthMiddleware(), handlers.SendMessageHandler)
 			chats.PATCH("/:id/messages/:messageId", handlers.AuthMiddleware(), handlers.UpdateMessageHandler)
 			chats.DELETE("/:id/messages/:messageId", handlers.AuthMiddleware(), handlers.DeleteMessageHandler)
+			chats.GET("/:id/messages/:messageId/receipts", handlers.AuthMiddleware(), handlers.GetMessageReceiptsHandler)
+			chats.GET("/:id/messages/:messageId/edits", handlers.AuthMiddleware(), handlers.GetMessageEditsHandler)
+			chats.GET("/:id/messages/:messageId/thread", handlers.AuthMiddleware(), handlers.GetThreadHandler)
+			chats.POST("/:id/messages/:messageId/reactions", handlers.AuthMiddleware(), handlers.AddReactionHandler)
+			chats.DELETE("/:id/messages/:messageId/reactions/:emoji", handlers.AuthMiddleware(), handlers.RemoveReactionHandler)
+			chats.POST("/:id/messages/:messageId/forward", handlers.AuthMiddleware(), handlers.ForwardMessageHandler)
+			chats.POST("/:id/messages/:messageId/pin", handlers.AuthMiddleware(), handlers.PinMessageHandler)
+			chats.DELETE("/:id/messages/:messageId/pin", handlers.AuthMiddleware(), handlers.UnpinMessageHandler)
+			chats.GET("/:id/pins", handlers.AuthMiddleware(), handlers.GetPinnedMessagesHandler)
+			chats.GET("/:id/scheduled", handlers.AuthMiddleware(), handlers.GetScheduledMessagesHandler)
+			chats.PATCH("/:id/scheduled/:scheduledId", handlers.AuthMiddleware(), handlers.UpdateScheduledMessageHandler)
+			chats.DELETE("/:id/scheduled/:scheduledId", handlers.AuthMiddleware(), handlers.CancelScheduledMessageHandler)
+			chats.POST("/:id/attachments", handlers.AuthMiddleware(), handlers.UploadAttachmentHandler)
+			chats.GET("/:id/attachments/:attachmentId", handlers.AuthMiddleware(), handlers.GetAttachmentHandler)
+			chats.GET("/:id/search", handlers.AuthMiddleware(), handlers.SearchChatMessagesHandler)
+		}
+
+		invites := api.Group("/invites")
+		{
+			invites.GET("/:token", handlers.AuthMiddleware(), handlers.PreviewInviteHandler)
+			invites.POST("/:token/join", handlers.AuthMiddleware(), handlers.JoinViaInviteHandler)
+		}
+
+		search := api.Group("/search")
+		{
+			search.GET("/messages", handlers.AuthMiddleware(), handlers.SearchMessagesHandler)
+		}
+
+		mentions := api.Group("/mentions")
+		{
+			mentions.GET("", handlers.AuthMiddleware(), handlers.GetMentionsHandler)
+			mentions.POST("/read", handlers.AuthMiddleware(), handlers.MarkMentionsReadHandler)
 		}
 
 		userRoutes := api.Group("/users")
 		userRoutes.Use(handlers.AuthMiddleware())
 		{
 			userRoutes.GET("", handlers.GetAllUsersHandler)
+			userRoutes.GET("/blocked", handlers.GetBlockedUsersHandler)
 			userRoutes.GET("/:id", handlers.GetUserProfileHandler)
 			userRoutes.PATCH("/:id", handlers.UpdateUserProfileHandler)
+			userRoutes.POST("/:id/block", handlers.BlockUserHandler)
+			userRoutes.DELETE("/:id/block", handlers.UnblockUserHandler)
 		}
 	}
 
 	r.GET("/ws", handlers.HandleWebSocket)
 
+	// Worker metrics are served on their own listener, off unless DEBUG_ADDR
+	// is set (e.g. 127.0.0.1:6060), so they are never public.
+	if debugAddr := os.Getenv("DEBUG_ADDR"); debugAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			log.Printf("Debug server starting on %s\n", debugAddr)
+			if err := http.ListenAndServe(debugAddr, mux); err != nil {
+				log.Printf("Debug server stopped: %v", err)
+			}
+		}()
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
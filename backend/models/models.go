@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,29 +16,164 @@ type User struct {
 	CreatedAt      time.Time              `json:"createdAt"`
 	UpdatedAt      time.Time              `json:"updatedAt"`
 	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	ReadReceipts   *bool                  `json:"readReceipts,omitempty"`
 }
 
 type Chat struct {
-	ID            uuid.UUID  `json:"id"`
-	Name          string     `json:"name"`
-	IsSecure      bool       `json:"isSecure"`
-	Folder        string     `json:"folder,omitempty"`
-	LastMessage   string     `json:"lastMessage,omitempty"`
-	LastMessageAt *time.Time `json:"lastMessageAt,omitempty"`
-	CreatedAt     time.Time  `json:"createdAt"`
-	UpdatedAt     time.Time  `json:"updatedAt"`
-	Members       []User     `json:"members,omitempty"`
+	ID                    uuid.UUID       `json:"id"`
+	Name                  string          `json:"name"`
+	Type                  string          `json:"type"`
+	IsSecure              bool            `json:"isSecure"`
+	Folder                string          `json:"folder,omitempty"`
+	Description           string          `json:"description,omitempty"`
+	Topic                 string          `json:"topic,omitempty"`
+	AvatarURL             string          `json:"avatarUrl,omitempty"`
+	SlowModeSeconds       int             `json:"slowModeSeconds"`
+	DefaultDisappearAfter int             `json:"defaultDisappearAfter"`
+	RetentionDays         int             `json:"retentionDays"`
+	LastMessage           string          `json:"lastMessage,omitempty"`
+	LastMessageAt         *time.Time      `json:"lastMessageAt,omitempty"`
+	CreatedAt             time.Time       `json:"createdAt"`
+	UpdatedAt             time.Time       `json:"updatedAt"`
+	UnreadCount           int             `json:"unreadCount"`
+	MemberCount           int             `json:"memberCount,omitempty"`
+	MemberSummary         []MemberSummary `json:"memberSummary,omitempty"`
+	Members               []User          `json:"members,omitempty"`
 }
 
-type Message struct {
+type MemberSummary struct {
 	ID             uuid.UUID `json:"id"`
-	ChatID         uuid.UUID `json:"chatId"`
-	SenderID       uuid.UUID `json:"senderId"`
-	Content        string    `json:"content"`
-	IsRead         bool      `json:"isRead"`
-	IsDisappearing bool      `json:"isDisappearing"`
-	DisappearAfter int       `json:"disappearAfter,omitempty"`
-	SentAt         time.Time `json:"sentAt"`
+	Username       string    `json:"username"`
+	DisplayName    string    `json:"displayName"`
+	ProfilePicture string    `json:"profilePicture,omitempty"`
+}
+
+type Message struct {
+	ID                uuid.UUID       `json:"id"`
+	ChatID            uuid.UUID       `json:"chatId"`
+	SenderID          uuid.UUID       `json:"senderId"`
+	ClientMessageID   string          `json:"clientMessageId,omitempty"`
+	Kind              string          `json:"kind"`
+	Content           string          `json:"content"`
+	Payload           json.RawMessage `json:"payload,omitempty"`
+	Entities          []MessageEntity `json:"entities,omitempty"`
+	IsRead            bool            `json:"isRead"`
+	Status            string          `json:"status,omitempty"`
+	IsDisappearing    bool            `json:"isDisappearing"`
+	DisappearAfter    int             `json:"disappearAfter,omitempty"`
+	DisappearFrom     string          `json:"disappearFrom,omitempty"`
+	ExpiresAt         *time.Time      `json:"expiresAt,omitempty"`
+	IsSystem          bool            `json:"isSystem,omitempty"`
+	SentAt            time.Time       `json:"sentAt"`
+	EditedAt          *time.Time      `json:"editedAt,omitempty"`
+	DeletedAt         *time.Time      `json:"deletedAt,omitempty"`
+	DeletedBy         *uuid.UUID      `json:"deletedBy,omitempty"`
+	ReplyToID         *uuid.UUID      `json:"replyToId,omitempty"`
+	ReplyTo           *MessageQuote   `json:"replyTo,omitempty"`
+	ThreadRootID      *uuid.UUID      `json:"threadRootId,omitempty"`
+	ReplyCount        int             `json:"replyCount,omitempty"`
+	ThreadUnreadCount int             `json:"threadUnreadCount,omitempty"`
+	IsForwarded       bool            `json:"isForwarded,omitempty"`
+	ForwardedFromID   *uuid.UUID      `json:"forwardedFromId,omitempty"`
+	IsPinned          bool            `json:"isPinned,omitempty"`
+	PinnedAt          *time.Time      `json:"pinnedAt,omitempty"`
+	PinnedBy          *uuid.UUID      `json:"pinnedBy,omitempty"`
+	Reactions         []Reaction      `json:"reactions,omitempty"`
+	Attachments       []Attachment    `json:"attachments,omitempty"`
+}
+
+const (
+	EntityMention    = "mention"
+	EntityMentionAll = "mention_all"
+)
+
+// MessageEntity marks a span of message content. Offset and Length are in
+// UTF-16 code units.
+type MessageEntity struct {
+	Type   string     `json:"type"`
+	Offset int        `json:"offset"`
+	Length int        `json:"length"`
+	UserID *uuid.UUID `json:"userId,omitempty"`
+}
+
+type Attachment struct {
+	ID          uuid.UUID  `json:"id"`
+	ChatID      uuid.UUID  `json:"chatId"`
+	MessageID   *uuid.UUID `json:"messageId,omitempty"`
+	UploaderID  uuid.UUID  `json:"uploaderId"`
+	FileName    string     `json:"fileName"`
+	ContentType string     `json:"contentType"`
+	Size        int64      `json:"size"`
+	URL         string     `json:"url"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+// Reaction is the aggregate for one emoji on a message.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reactedByMe"`
+}
+
+// MessageQuote is the short preview of a replied-to message shown with the
+// reply. Snippet is empty when the parent was deleted or is disappearing.
+type MessageQuote struct {
+	ID         uuid.UUID `json:"id"`
+	SenderID   uuid.UUID `json:"senderId"`
+	SenderName string    `json:"senderName"`
+	Snippet    string    `json:"snippet"`
+	IsDeleted  bool      `json:"isDeleted,omitempty"`
+}
+
+// MessageEdit is a previous version of a message's content. EditedAt is when
+// that version was replaced.
+type MessageEdit struct {
+	ID        uuid.UUID `json:"id"`
+	MessageID uuid.UUID `json:"messageId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+}
+
+// MessageReceipt is one member's delivery and read state for a message.
+type MessageReceipt struct {
+	UserID      uuid.UUID  `json:"userId"`
+	DisplayName string     `json:"displayName"`
+	Status      string     `json:"status"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+}
+
+type ChatEdit struct {
+	ID       uuid.UUID  `json:"id"`
+	ChatID   uuid.UUID  `json:"chatId"`
+	Field    string     `json:"field"`
+	OldValue string     `json:"oldValue"`
+	NewValue string     `json:"newValue"`
+	EditedBy *uuid.UUID `json:"editedBy,omitempty"`
+	EditedAt time.Time  `json:"editedAt"`
+}
+
+type ChatInvite struct {
+	ID               uuid.UUID  `json:"id"`
+	ChatID           uuid.UUID  `json:"chatId"`
+	Token            string     `json:"token"`
+	URL              string     `json:"url"`
+	CreatedBy        uuid.UUID  `json:"createdBy"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	MaxUses          *int       `json:"maxUses,omitempty"`
+	UseCount         int        `json:"useCount"`
+	RequiresApproval bool       `json:"requiresApproval"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+}
+
+type JoinRequest struct {
+	ID        uuid.UUID  `json:"id"`
+	ChatID    uuid.UUID  `json:"chatId"`
+	InviteID  *uuid.UUID `json:"inviteId,omitempty"`
+	User      User       `json:"user"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"createdAt"`
 }
 
 type RegisterRequest struct {
@@ -56,3 +192,39 @@ type AuthResponse struct {
 	RefreshToken string `json:"refreshToken"`
 	User         User   `json:"user"`
 }
+
+// ScheduledMessage is a message waiting to be sent at SendAt. Only its
+// sender can see it. Once sent it becomes a Message with the same ID.
+type ScheduledMessage struct {
+	ID              uuid.UUID       `json:"id"`
+	ChatID          uuid.UUID       `json:"chatId"`
+	SenderID        uuid.UUID       `json:"senderId"`
+	ClientMessageID string          `json:"clientMessageId,omitempty"`
+	Kind            string          `json:"kind"`
+	Content         string          `json:"content"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	IsDisappearing  bool            `json:"isDisappearing"`
+	DisappearAfter  int             `json:"disappearAfter,omitempty"`
+	DisappearFrom   string          `json:"disappearFrom,omitempty"`
+	ReplyToID       *uuid.UUID      `json:"replyToId,omitempty"`
+	Mentions        []string        `json:"mentions,omitempty"`
+	Attachments     []Attachment    `json:"attachments,omitempty"`
+	SendAt          time.Time       `json:"sendAt"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+// Mention is one entry in a user's mentions feed.
+type Mention struct {
+	Message Message `json:"message"`
+	IsRead  bool    `json:"isRead"`
+}
+
+// SearchResult is one message matched by a search, with Snippet holding the
+// matching text HTML-escaped and the matches wrapped in <mark> tags.
+type SearchResult struct {
+	Message    Message `json:"message"`
+	ChatName   string  `json:"chatName"`
+	SenderName string  `json:"senderName"`
+	Snippet    string  `json:"snippet"`
+}
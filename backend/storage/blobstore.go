@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps uploaded file contents. Keys are slash-separated paths
+// chosen by the caller.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv builds the store selected by BLOB_STORE: "local" (the default),
+// which writes under UPLOAD_DIR, or "s3", configured by the S3_* variables.
+func FromEnv() BlobStore {
+	switch os.Getenv("BLOB_STORE") {
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") != "false",
+		})
+	case "", "local":
+		dir := os.Getenv("UPLOAD_DIR")
+		if dir == "" {
+			dir = "data/uploads"
+		}
+		return NewLocalStore(dir)
+	default:
+		log.Printf("Unknown BLOB_STORE %q, using local storage", os.Getenv("BLOB_STORE"))
+		return NewLocalStore("data/uploads")
+	}
+}